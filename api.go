@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The JSON API under /api is for the command line client and other
+// programs. It is not used from a browser: its routes are not subject to
+// CSRF checks, and those changing anything only accept PUT and DELETE,
+// which browsers do not send across origins without asking first.
+
+// runStartWait is how long starting a run is waited for before the API
+// reports it as queued.
+const runStartWait = 5 * time.Second
+
+type scriptRecord struct {
+	ID                   int        `json:"id"`
+	Name                 string     `json:"name"`
+	Owner                user       `json:"owner"`
+	Kind                 string     `json:"kind"`
+	PeriodicRunsEnabled  bool       `json:"periodic_runs_enabled"`
+	RunPeriod            string     `json:"run_period,omitempty"`
+	ScheduledRunsEnabled bool       `json:"scheduled_runs_enabled"`
+	Scheduled            *time.Time `json:"scheduled,omitempty"`
+	GitPath              string     `json:"git_path,omitempty"`
+	GitOrphaned          bool       `json:"git_orphaned,omitempty"`
+	Running              bool       `json:"running"`
+	LastRun              *runRecord `json:"last_run,omitempty"`
+	Text                 string     `json:"text,omitempty"`
+}
+
+func newScriptRecord(s *Script) scriptRecord {
+	rec := scriptRecord{
+		ID:                   s.ID,
+		Name:                 s.Name,
+		Owner:                s.Owner,
+		Kind:                 s.Kind,
+		PeriodicRunsEnabled:  s.PeriodicRunsEnabled,
+		RunPeriod:            s.RunPeriod,
+		ScheduledRunsEnabled: s.ScheduledRunsEnabled,
+		Scheduled:            s.Scheduled,
+		GitPath:              s.GitPath,
+		GitOrphaned:          s.GitOrphaned,
+	}
+	var last Run
+	if s.RunCounter > 0 && db.Where("script_id = ? AND run_no = ?", s.ID, s.RunCounter).First(&last).Error == nil {
+		lastRec := newRunRecord(last)
+		rec.LastRun = &lastRec
+		rec.Running = last.State.Running()
+	}
+	return rec
+}
+
+func requireAPIUser(handler func(http.ResponseWriter, *http.Request, user)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := getRequestUser(r)
+		if u == "" {
+			if usesSessions() {
+				w.Header().Set("WWW-Authenticate", `Basic realm="runtriggers"`)
+			}
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+		handler(w, withUser(r, u), u)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiLookupScript(w http.ResponseWriter, r *http.Request) (*Script, bool) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	s, ok := allScripts.lookup(id)
+	if !ok {
+		http.Error(w, "no such script", 404)
+	}
+	return s, ok
+}
+
+func apiListScripts(w http.ResponseWriter, r *http.Request, u user) {
+	scripts := allScripts.get()
+	sort.Slice(scripts, func(i, j int) bool { return scripts[i].Name < scripts[j].Name })
+
+	recs := make([]scriptRecord, 0, len(scripts))
+	for _, s := range scripts {
+		recs = append(recs, newScriptRecord(s))
+	}
+	writeJSON(w, 200, recs)
+}
+
+func apiShowScript(w http.ResponseWriter, r *http.Request, u user) {
+	s, ok := apiLookupScript(w, r)
+	if !ok {
+		return
+	}
+	rec := newScriptRecord(s)
+	rec.Text = s.Text
+	writeJSON(w, 200, rec)
+}
+
+// apiPutText replaces the text of a script with the request body.
+func apiPutText(w http.ResponseWriter, r *http.Request, u user) {
+	s, ok := apiLookupScript(w, r)
+	if !ok {
+		return
+	}
+	if s.GitPath != "" {
+		http.Error(w, "the script is defined in git and cannot be changed here", 409)
+		return
+	}
+
+	text, err := ioutil.ReadAll(io.LimitReader(r.Body, *flagMaxImportSize))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	newScript := s.Copy()
+	newScript.Text = strings.ReplaceAll(string(text), "\r\n", "\n")
+	if err := allScripts.save(&newScript); err != nil {
+		http.Error(w, fmt.Sprintf("failed to save script: %s", err), 409)
+		return
+	}
+	audit(r, u, ActionUpdate, s.ID, 0, url.Values{"Name": {s.Name}})
+
+	writeJSON(w, 200, newScriptRecord(&newScript))
+}
+
+func apiListRuns(w http.ResponseWriter, r *http.Request, u user) {
+	s, ok := apiLookupScript(w, r)
+	if !ok {
+		return
+	}
+	limit := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > 1000 {
+			http.Error(w, "limit must be a number from 1 to 1000", 400)
+			return
+		}
+	}
+
+	var runs []Run
+	if err := db.Where("script_id = ?", s.ID).Order("run_no desc").Limit(limit).Find(&runs).Error; err != nil {
+		reqLog(r).Error("failed to query runs", "err", err)
+		http.Error(w, "failed to query runs", 500)
+		return
+	}
+	recs := make([]runRecord, 0, len(runs))
+	for _, run := range runs {
+		recs = append(recs, newRunRecord(run))
+	}
+	writeJSON(w, 200, recs)
+}
+
+func apiLookupRun(w http.ResponseWriter, r *http.Request) (Run, bool) {
+	var run Run
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	runNo, _ := strconv.Atoi(vars["runno"])
+	if err := db.Where("script_id = ? AND run_no = ?", id, runNo).First(&run).Error; err != nil {
+		http.Error(w, "no such run", 404)
+		return run, false
+	}
+	return run, true
+}
+
+func apiShowRun(w http.ResponseWriter, r *http.Request, u user) {
+	if run, ok := apiLookupRun(w, r); ok {
+		writeJSON(w, 200, newRunRecord(run))
+	}
+}
+
+// apiLog sends the log of a run. With follow=1, the response is kept open
+// and the log streamed as it grows, until the run ends.
+func apiLog(w http.ResponseWriter, r *http.Request, u user) {
+	run, ok := apiLookupRun(w, r)
+	if !ok {
+		return
+	}
+	follow := r.URL.Query().Get("follow") == "1"
+	if !follow {
+		http.ServeFile(w, r, run.LogFilename)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	for {
+		var changech chan struct{}
+		if s, ok := allScripts.lookup(run.ScriptID); ok {
+			changech = s.getChangech()
+		}
+		// read the state before the log, so that nothing written after
+		// the last read is missed once the run is seen to have ended
+		if err := db.Where("script_id = ? AND run_no = ?", run.ScriptID, run.RunNo).First(&run).Error; err != nil {
+			reqLog(r).Warn("failed to re-read run", "err", err)
+			return
+		}
+
+		if f == nil {
+			var err error
+			// the run is recorded before its log file is created
+			if f, err = os.Open(run.LogFilename); err != nil && !(os.IsNotExist(err) && run.State.Running()) {
+				reqLog(r).Warn("failed to open log", "path", run.LogFilename, "err", err)
+				return
+			}
+		}
+		if f != nil {
+			if _, err := io.Copy(w, f); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if !run.State.Running() {
+			return
+		}
+
+		select {
+		case <-changech:
+		case <-time.After(500 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+type runRequest struct {
+	Params map[string]string `json:"params"`
+}
+
+type runResponse struct {
+	RunNo  int  `json:"run_no,omitempty"`
+	Queued bool `json:"queued,omitempty"`
+}
+
+// apiRun triggers a manual run, with the parameters from the optional JSON
+// body.
+func apiRun(w http.ResponseWriter, r *http.Request, u user) {
+	s, ok := apiLookupScript(w, r)
+	if !ok {
+		return
+	}
+
+	var req runRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, *flagMaxImportSize)).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("parsing body: %s", err), 400)
+		return
+	}
+	params := url.Values{}
+	for name, value := range req.Params {
+		params.Set(name, value)
+	}
+	if _, err := paramEnv(params); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	started, err := s.manual(u, params)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not trigger a run: %s", err), 409)
+		return
+	}
+
+	select {
+	case runNo := <-started:
+		if runNo == 0 {
+			http.Error(w, "failed to start the run", 500)
+			return
+		}
+		audit(r, u, ActionRun, s.ID, runNo, params)
+		writeJSON(w, 200, runResponse{RunNo: runNo})
+	case <-time.After(runStartWait):
+		// the script is running, the run starts after it
+		audit(r, u, ActionRun, s.ID, 0, params)
+		writeJSON(w, 202, runResponse{Queued: true})
+	}
+}
+
+// apiSchedule schedules a run at the time in the body, in the syntax of
+// the schedule form, or clears the schedule on DELETE.
+func apiSchedule(w http.ResponseWriter, r *http.Request, u user) {
+	s, ok := apiLookupScript(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == "DELETE" {
+		s.unschedule()
+		audit(r, u, ActionUnschedule, s.ID, 0, nil)
+		w.WriteHeader(204)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	t, err := parseTime(strings.TrimSpace(string(body)))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parsing body: %s", err), 400)
+		return
+	}
+
+	s.schedule(t)
+	audit(r, u, ActionSchedule, s.ID, 0, url.Values{"Time": {string(body)}})
+	writeJSON(w, 200, struct {
+		Scheduled time.Time `json:"scheduled"`
+		Enabled   bool      `json:"scheduled_runs_enabled"`
+	}{t, s.ScheduledRunsEnabled})
+}
+
+func apiKill(w http.ResponseWriter, r *http.Request, u user) {
+	s, ok := apiLookupScript(w, r)
+	if !ok {
+		return
+	}
+	signo, _ := strconv.Atoi(mux.Vars(r)["signo"])
+
+	var runNo int
+	sig, err := killSignal(signo)
+	if err == nil {
+		runNo, err = s.kill(sig)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not send signal: %s", err), 409)
+		return
+	}
+	audit(r, u, ActionKill, s.ID, runNo, url.Values{"Signal": {strconv.Itoa(signo)}})
+	w.WriteHeader(204)
+}
+
+func apiRoutes(r *mux.Router) {
+	api := r.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/backup", requireAPIUser(apiBackup)).Methods("PUT")
+	api.HandleFunc("/scripts", requireAPIUser(apiListScripts)).Methods("GET")
+	api.HandleFunc("/scripts/{id:[0-9]+}", requireAPIUser(apiShowScript)).Methods("GET")
+	api.HandleFunc("/scripts/{id:[0-9]+}/text", requireAPIUser(apiPutText)).Methods("PUT")
+	api.HandleFunc("/scripts/{id:[0-9]+}/run", requireAPIUser(apiRun)).Methods("PUT")
+	api.HandleFunc("/scripts/{id:[0-9]+}/schedule", requireAPIUser(apiSchedule)).Methods("PUT", "DELETE")
+	api.HandleFunc("/scripts/{id:[0-9]+}/kill/{signo:[0-9]+}", requireAPIUser(apiKill)).Methods("PUT")
+	api.HandleFunc("/scripts/{id:[0-9]+}/runs", requireAPIUser(apiListRuns)).Methods("GET")
+	api.HandleFunc("/scripts/{id:[0-9]+}/runs/{runno:[0-9]+}", requireAPIUser(apiShowRun)).Methods("GET")
+	api.HandleFunc("/scripts/{id:[0-9]+}/runs/{runno:[0-9]+}/log", requireAPIUser(apiLog)).Methods("GET")
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditEntry is one row of the append-only audit table. A row is written
+// for every request which changes the state of a script or a run, or sends
+// something out on the script's behalf.
+type AuditEntry struct {
+	ID         int `gorm:"primary_key"`
+	Time       time.Time
+	Actor      user
+	Action     string
+	ScriptID   int
+	RunNo      int
+	Params     string
+	RemoteAddr string
+}
+
+const (
+	ActionCreate     = "create"
+	ActionUpdate     = "update"
+	ActionRun        = "run"
+	ActionDelete     = "delete"
+	ActionSchedule   = "schedule"
+	ActionUnschedule = "unschedule"
+	ActionKill       = "kill"
+	ActionNotifyTest = "notify-test"
+	ActionImport     = "import"
+	ActionBackup     = "backup"
+)
+
+var auditActions = []string{
+	ActionCreate,
+	ActionUpdate,
+	ActionRun,
+	ActionDelete,
+	ActionSchedule,
+	ActionUnschedule,
+	ActionKill,
+	ActionNotifyTest,
+	ActionImport,
+	ActionBackup,
+}
+
+// unauditedFormFields lists form fields which are not stored in the audit
+// table, because they are big (the script text), secret, or carry no
+// information about the action.
+var unauditedFormFields = map[string]bool{
+	"Text":               true,
+	"WebhookSecret":      true,
+	"gorilla.csrf.Token": true,
+}
+
+// requestSource returns the address the request came from. Behind trusted
+// proxies, that is the last address in X-Forwarded-For which is not one of
+// them; the addresses before it could have been made up by the client.
+func requestSource(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" && fromProxy(r, trustedProxies) {
+		hops := strings.Split(fwd, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if i == 0 || !containsIP(trustedProxies, net.ParseIP(hop)) {
+				return hop
+			}
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func auditParams(form url.Values) string {
+	params := make(url.Values)
+	for k, v := range form {
+		if !unauditedFormFields[k] {
+			params[k] = v
+		}
+	}
+	return params.Encode()
+}
+
+func audit(r *http.Request, u user, action string, scriptID int, runNo int, params url.Values) {
+	entry := AuditEntry{
+		Time:       time.Now(),
+		Actor:      u,
+		Action:     action,
+		ScriptID:   scriptID,
+		RunNo:      runNo,
+		Params:     auditParams(params),
+		RemoteAddr: requestSource(r),
+	}
+
+	if err := db.Create(&entry).Error; err != nil {
+		reqLog(r).Error("failed to record audit entry", "action", action, "script_id", scriptID, "run_no", runNo, "err", err)
+	}
+}
+
+// auditAs records an action not taken through a request, but by the command
+// line tools or the git synchronization.
+func auditAs(actor user, source string, action string, scriptID int, params url.Values) {
+	entry := AuditEntry{
+		Time:       time.Now(),
+		Actor:      actor,
+		Action:     action,
+		ScriptID:   scriptID,
+		Params:     auditParams(params),
+		RemoteAddr: source,
+	}
+
+	if err := db.Create(&entry).Error; err != nil {
+		slog.Error("failed to record audit entry", "action", action, "script_id", scriptID, "err", err)
+	}
+}
+
+func listAudit(w http.ResponseWriter, r *http.Request, u user) {
+	if !u.IsAdmin() {
+		http.Error(w, errForbidden.Error(), 403)
+		return
+	}
+
+	flashMessages := getFlashMessages(w, r)
+	r.ParseForm()
+
+	query := db.Order("id desc").Limit(100)
+	if actor := r.Form.Get("actor"); actor != "" {
+		query = query.Where("actor = ?", actor)
+	}
+	if action := r.Form.Get("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if scriptID, err := strconv.Atoi(r.Form.Get("script")); err == nil {
+		query = query.Where("script_id = ?", scriptID)
+	}
+	if before, err := strconv.Atoi(r.Form.Get("before")); err == nil {
+		query = query.Where("id < ?", before)
+	}
+	for _, bound := range []struct{ field, op string }{{"from", ">="}, {"to", "<="}} {
+		if v := r.Form.Get(bound.field); v != "" {
+			t, err := parseTime(v)
+			if err != nil {
+				flashMessages = append(flashMessages, flashMessage{
+					ID:   "error",
+					Args: []string{"Bad time '" + v + "': " + err.Error()},
+				})
+				continue
+			}
+			query = query.Where("time "+bound.op+" ?", t)
+		}
+	}
+
+	var entries []AuditEntry
+	if err := query.Find(&entries).Error; err != nil {
+		flashMessages = append(flashMessages, flashMessage{
+			ID:   "error",
+			Args: []string{"Failed to query audit log: " + err.Error()},
+		})
+	}
+
+	var older string
+	if len(entries) == 100 {
+		q := url.Values{}
+		for k, v := range r.Form {
+			q[k] = v
+		}
+		q.Set("before", strconv.Itoa(entries[len(entries)-1].ID))
+		older = Link("/audit") + "?" + q.Encode()
+	}
+
+	execTmpl(w, r, "audit", map[string]interface{}{
+		"user":          u,
+		"flashMessages": flashMessages,
+		"entries":       entries,
+		"actions":       auditActions,
+		"filter":        r.Form,
+		"older":         older,
+	})
+}
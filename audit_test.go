@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRequestSource(t *testing.T) {
+	var err error
+	if trustedProxies, err = parseProxies("127.0.0.0/8, 10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { trustedProxies = nil }()
+
+	for _, tc := range []struct {
+		remote, forwarded, want string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		// only trusted proxies may say where requests come from
+		{"192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{"127.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		// addresses in front of the first untrusted one can be forged
+		{"127.0.0.1:1234", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		{"127.0.0.1:1234", "203.0.113.9, 198.51.100.7, 10.1.2.3", "198.51.100.7"},
+		{"127.0.0.1:1234", "10.1.2.3", "10.1.2.3"},
+		// unix sockets
+		{"@", "198.51.100.7", "198.51.100.7"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := requestSource(r); got != tc.want {
+			t.Errorf("%s forwarding %q: got %s, want %s", tc.remote, tc.forwarded, got, tc.want)
+		}
+	}
+}
+
+func TestAuditParams(t *testing.T) {
+	form := url.Values{
+		"Name":               {"deploy"},
+		"Text":               {"#!/bin/sh\nmake deploy"},
+		"WebhookSecret":      {"s3cret"},
+		"gorilla.csrf.Token": {"token"},
+	}
+	if got := auditParams(form); got != "Name=deploy" {
+		t.Errorf("auditParams = %q", got)
+	}
+}
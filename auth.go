@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	flagAuth           = flag.String("auth", "header", "authentication backend: header, htpasswd, pam or oidc")
+	flagAuthHeader     = flag.String("auth-header", "X-Forwarded-User", "request header carrying the username (header authentication)")
+	flagTrustedProxies = flag.String("trusted-proxies", "127.0.0.0/8,::1/128", "comma-separated list of CIDRs of proxies trusted to set X-Forwarded-For and the username header (header authentication)")
+	flagHtpasswd       = flag.String("htpasswd", "", "path to an htpasswd file with bcrypt password hashes (htpasswd authentication)")
+	flagPAMService     = flag.String("pam-service", "runtriggers", "PAM service name (pam authentication)")
+	flagSessionKey     = flag.String("session-key", "", "path to a file with a 64-byte key for signing and encrypting session cookies (a random key is generated on startup if not given)")
+	flagSessionMaxAge  = flag.Duration("session-max-age", 12*time.Hour, "time after which users have to log in again")
+)
+
+var (
+	errBadCredentials = errors.New("bad username or password")
+)
+
+// authenticator finds out which user a request comes from. An empty user
+// and a nil error mean the request carries no credentials.
+type authenticator interface {
+	authenticate(r *http.Request) (user, error)
+}
+
+// passwordChecker is implemented by backends which verify a username and
+// password pair, those are served by the login form and HTTP Basic auth.
+type passwordChecker interface {
+	checkPassword(username, password string) error
+}
+
+var auth authenticator
+
+func initAuth() {
+	var err error
+
+	if trustedProxies, err = parseProxies(*flagTrustedProxies); err != nil {
+		fatal("bad -trusted-proxies", "err", err)
+	}
+
+	switch *flagAuth {
+	case "header":
+		auth, err = newHeaderAuth(*flagAuthHeader, *flagTrustedProxies)
+	case "htpasswd":
+		h := &htpasswdFile{path: *flagHtpasswd}
+		err = h.load()
+		auth = &sessionAuth{passwords: h}
+	case "pam":
+		if !pamSupported {
+			err = errors.New("runtriggers built without PAM support, rebuild with -tags pam")
+		}
+		auth = &sessionAuth{passwords: &pamAuth{service: *flagPAMService}}
+	case "oidc":
+		var o *oidcAuth
+		if o, err = newOIDCAuth(); err == nil {
+			auth = &sessionAuth{oidc: o}
+		}
+	default:
+		err = fmt.Errorf("unknown authentication backend %q", *flagAuth)
+	}
+	if err != nil {
+		fatal("failed to set up authentication", "backend", *flagAuth, "err", err)
+	}
+
+	if _, ok := auth.(*sessionAuth); ok {
+		initSessions()
+	}
+}
+
+// usesSessions tells if users log in through runtriggers itself, as opposed
+// to being authenticated by a reverse proxy.
+func usesSessions() bool {
+	_, ok := auth.(*sessionAuth)
+	return ok && *flagMockUser == ""
+}
+
+type headerAuth struct {
+	header  string
+	proxies []*net.IPNet
+}
+
+func newHeaderAuth(header string, proxies string) (*headerAuth, error) {
+	ipnets, err := parseProxies(proxies)
+	if err != nil {
+		return nil, err
+	}
+	return &headerAuth{header: header, proxies: ipnets}, nil
+}
+
+func (a *headerAuth) trusted(r *http.Request) bool {
+	return fromProxy(r, a.proxies)
+}
+
+// trustedProxies are the proxies from -trusted-proxies.
+var trustedProxies []*net.IPNet
+
+func parseProxies(list string) ([]*net.IPNet, error) {
+	var ipnets []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ipnets = append(ipnets, ipnet)
+	}
+	return ipnets, nil
+}
+
+func containsIP(ipnets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range ipnets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromProxy tells if the request comes from one of the proxies.
+func fromProxy(r *http.Request, proxies []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// connections over a unix socket have no remote address, the
+		// socket's permissions restrict who can connect
+		return r.RemoteAddr == "@" || r.RemoteAddr == ""
+	}
+	return containsIP(proxies, net.ParseIP(host))
+}
+
+func (a *headerAuth) authenticate(r *http.Request) (user, error) {
+	u := r.Header.Get(a.header)
+	if u == "" {
+		return "", nil
+	}
+	if !a.trusted(r) {
+		return "", fmt.Errorf("%s header from untrusted address %s", a.header, r.RemoteAddr)
+	}
+	return user(u), nil
+}
+
+// htpasswdFile checks passwords against an Apache htpasswd file. Only
+// bcrypt hashes (htpasswd -B) are supported. The file is re-read when it
+// changes.
+type htpasswdFile struct {
+	path string
+
+	sync.Mutex
+	modTime time.Time
+	hashes  map[string][]byte
+}
+
+func (h *htpasswdFile) load() error {
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	if h.hashes != nil && fi.ModTime().Equal(h.modTime) {
+		return nil
+	}
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hashes := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.IndexByte(line, ':')
+		if sep == -1 {
+			continue
+		}
+		name, hash := line[:sep], line[sep+1:]
+		if !strings.HasPrefix(hash, "$2") {
+			slog.Warn("ignoring htpasswd user, password not hashed with bcrypt", "path", h.path, "user", name)
+			continue
+		}
+		hashes[name] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	h.hashes = hashes
+	h.modTime = fi.ModTime()
+	return nil
+}
+
+func (h *htpasswdFile) checkPassword(username, password string) error {
+	h.Lock()
+	if err := h.load(); err != nil {
+		h.Unlock()
+		return fmt.Errorf("reading htpasswd file: %s", err)
+	}
+	hash, ok := h.hashes[username]
+	h.Unlock()
+
+	if !ok {
+		return errBadCredentials
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return errBadCredentials
+	}
+	return nil
+}
+
+const (
+	sessionCookie = "runtriggers_session"
+)
+
+var sessionCodec *securecookie.SecureCookie
+
+type session struct {
+	User    user
+	Expires time.Time
+}
+
+func initSessions() {
+	key := make([]byte, 64)
+
+	if *flagSessionKey == "" {
+		if _, err := rand.Read(key); err != nil {
+			fatal("failed to generate session key", "err", err)
+		}
+	} else {
+		content, err := ioutil.ReadFile(*flagSessionKey)
+		if err != nil {
+			fatal("failed to read session key", "err", err)
+		}
+		if len(content) < len(key) {
+			fatal("session key too short", "path", *flagSessionKey, "min_bytes", len(key))
+		}
+		copy(key, content)
+	}
+
+	sessionCodec = securecookie.New(key[:32], key[32:])
+	sessionCodec.MaxAge(int(flagSessionMaxAge.Seconds()))
+}
+
+func setCookie(w http.ResponseWriter, name string, value interface{}, maxAge time.Duration) error {
+	encoded, err := sessionCodec.Encode(name, value)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    encoded,
+		Path:     Link("/"),
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   *flagSecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func getCookie(r *http.Request, name string, value interface{}) error {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+	return sessionCodec.Decode(name, c.Value, value)
+}
+
+func clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Path: Link("/"), MaxAge: -1})
+}
+
+func startSession(w http.ResponseWriter, u user) error {
+	return setCookie(w, sessionCookie, session{
+		User:    u,
+		Expires: time.Now().Add(*flagSessionMaxAge),
+	}, *flagSessionMaxAge)
+}
+
+// sessionAuth authenticates requests by a session cookie set on login. For
+// non-browser clients, backends checking passwords accept HTTP Basic auth
+// too.
+type sessionAuth struct {
+	passwords passwordChecker
+	oidc      *oidcAuth
+}
+
+func (a *sessionAuth) authenticate(r *http.Request) (user, error) {
+	if username, password, ok := r.BasicAuth(); ok && a.passwords != nil {
+		if err := a.passwords.checkPassword(username, password); err != nil {
+			return "", fmt.Errorf("basic auth of %q: %s", username, err)
+		}
+		return user(username), nil
+	}
+
+	var s session
+	if err := getCookie(r, sessionCookie, &s); err != nil {
+		if err == http.ErrNoCookie {
+			return "", nil
+		}
+		return "", err
+	}
+	if time.Now().After(s.Expires) {
+		return "", nil
+	}
+	return s.User, nil
+}
+
+// loginRedirect sends an unauthenticated browser to the login page,
+// remembering where it was heading.
+func loginRedirect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+	http.Redirect(w, r, Link("/login")+"?"+url.Values{"next": {r.URL.RequestURI()}}.Encode(), http.StatusFound)
+}
+
+// safeNext returns the path to continue to after login, refusing to
+// redirect anywhere outside of runtriggers.
+func safeNext(next string) string {
+	// browsers take /\ like //, for another host
+	if next == "" || !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func login(w http.ResponseWriter, r *http.Request) {
+	a, ok := auth.(*sessionAuth)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	r.ParseForm()
+	next := safeNext(r.Form.Get("next"))
+
+	if a.oidc != nil {
+		a.oidc.redirect(w, r, next)
+		return
+	}
+
+	var flashMessages []flashMessage
+	username := r.Form.Get("username")
+
+	if r.Method == "POST" {
+		err := a.passwords.checkPassword(username, r.Form.Get("password"))
+		if err == nil {
+			err = startSession(w, user(username))
+		}
+		if err == nil {
+			reqLog(r).Info("user logged in", "user", username)
+			http.Redirect(w, r, Link(next), http.StatusFound)
+			return
+		}
+		reqLog(r).Warn("failed login", "user", username, "err", err)
+		flashMessages = append(flashMessages, flashMessage{ID: "error", Args: []string{errBadCredentials.Error()}})
+	}
+
+	execTmpl(w, r, "login", map[string]interface{}{
+		"flashMessages": flashMessages,
+		"username":      username,
+		"next":          next,
+	})
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
+	clearCookie(w, sessionCookie)
+	http.Redirect(w, r, Link("/"), http.StatusFound)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSafeNext(t *testing.T) {
+	for next, want := range map[string]string{
+		"":                     "/",
+		"/":                    "/",
+		"/scripts/1?tab=runs":  "/scripts/1?tab=runs",
+		"scripts/1":            "/",
+		"https://evil.example": "/",
+		"//evil.example":       "/",
+		"/\\evil.example":      "/",
+	} {
+		if got := safeNext(next); got != want {
+			t.Errorf("safeNext(%q) = %q, want %q", next, got, want)
+		}
+	}
+}
+
+func TestHeaderAuth(t *testing.T) {
+	a, err := newHeaderAuth("X-Forwarded-User", "127.0.0.0/8, ::1/128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		remote, header string
+		want           user
+		wantErr        bool
+	}{
+		{"127.0.0.1:1234", "alice", "alice", false},
+		{"[::1]:1234", "alice", "alice", false},
+		{"@", "alice", "alice", false},
+		{"192.0.2.1:1234", "alice", "", true},
+		{"192.0.2.1:1234", "", "", false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.header != "" {
+			r.Header.Set("X-Forwarded-User", tc.header)
+		}
+		u, err := a.authenticate(r)
+		if u != tc.want || (err != nil) != tc.wantErr {
+			t.Errorf("%s with %q: got %q, %v", tc.remote, tc.header, u, err)
+		}
+	}
+
+	if _, err := newHeaderAuth("X-Forwarded-User", "not-a-cidr"); err == nil {
+		t.Error("bad CIDR accepted")
+	}
+}
+
+func writeHtpasswd(t *testing.T, path string, modTime time.Time, passwords map[string]string) {
+	content := "# comment\nlegacy:$apr1$abcdefgh$0123456789abcdefghijkl\n"
+	for name, password := range passwords {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content += fmt.Sprintf("%s:%s\n", name, hash)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	start := time.Now().Add(-time.Hour)
+	writeHtpasswd(t, path, start, map[string]string{"alice": "secret"})
+
+	h := &htpasswdFile{path: path}
+	if err := h.load(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+		// not bcrypt, ignored
+		{"legacy", "anything", false},
+	} {
+		err := h.checkPassword(tc.username, tc.password)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s/%s: %v", tc.username, tc.password, err)
+		}
+		if err != nil && err != errBadCredentials {
+			t.Errorf("%s/%s: unexpected error %v", tc.username, tc.password, err)
+		}
+	}
+
+	// the file is re-read when it changes
+	writeHtpasswd(t, path, start.Add(time.Minute), map[string]string{"bob": "hunter2"})
+	if err := h.checkPassword("bob", "hunter2"); err != nil {
+		t.Errorf("new user: %v", err)
+	}
+	if err := h.checkPassword("alice", "secret"); err == nil {
+		t.Error("removed user still accepted")
+	}
+
+	os.Remove(path)
+	if err := h.checkPassword("bob", "hunter2"); err == nil || err == errBadCredentials {
+		t.Errorf("missing file: %v", err)
+	}
+}
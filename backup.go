@@ -0,0 +1,528 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+var (
+	flagBackupDir      = flag.String("backup-dir", "", "directory to write backups to, on request of an admin or every -backup-interval")
+	flagBackupInterval = flag.Duration("backup-interval", 0, "how often to back up to -backup-dir (0 disables scheduled backups)")
+	flagBackupKeep     = flag.Int("backup-keep", 7, "number of backups to keep in -backup-dir")
+	flagBackupNoLogs   = flag.Bool("backup-no-logs", false, "leave run logs out of scheduled backups")
+)
+
+// A backup is a gzipped tar archive of a manifest, a copy of the SQLite
+// database made with its online backup API, and optionally the run logs.
+// It is consistent even when made while runtriggers runs: the database is
+// copied at one point in time, logs are added after it.
+const (
+	backupVersion  = 1
+	backupManifest = "manifest.json"
+	backupDatabase = "runtriggers.db"
+	backupLogs     = "logs/"
+)
+
+type manifest struct {
+	Version       int       `json:"version"`
+	Created       time.Time `json:"created"`
+	SchemaVersion int       `json:"schema_version"`
+	LogDir        string    `json:"log_dir"`
+	Logs          bool      `json:"logs"`
+}
+
+// copyDatabase copies the open SQLite database to a new file at path.
+func copyDatabase(path string) error {
+	if db.Dialect().GetName() != "sqlite3" {
+		return errors.New("only SQLite databases can be backed up, use pg_dump for PostgreSQL")
+	}
+
+	dest, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	ctx := context.Background()
+	srcConn, err := db.DB().Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(d interface{}) error {
+		return srcConn.Raw(func(s interface{}) error {
+			b, err := d.(*sqlite3.SQLiteConn).Backup("main", s.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err := b.Step(-1); err != nil {
+				b.Finish()
+				return err
+			}
+			return b.Finish()
+		})
+	})
+}
+
+func addFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// a log may grow while it is copied, the header has its size from before
+	_, err = io.CopyN(tw, f, fi.Size())
+	return err
+}
+
+// writeBackup writes a backup of the database and, if withLogs is set, the
+// log directory.
+func writeBackup(w io.Writer, withLogs bool) error {
+	tmp, err := ioutil.TempFile("", "runtriggers-backup-*.db")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	defer os.Remove(tmp.Name())
+	if err := copyDatabase(tmp.Name()); err != nil {
+		return fmt.Errorf("copying database: %v", err)
+	}
+
+	version, err := schemaVersionOf(db)
+	if err != nil {
+		return err
+	}
+	m, err := json.MarshalIndent(manifest{
+		Version:       backupVersion,
+		Created:       time.Now(),
+		SchemaVersion: version,
+		LogDir:        *flagLogDir,
+		Logs:          withLogs,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err = tw.WriteHeader(&tar.Header{Name: backupManifest, Mode: 0644, Size: int64(len(m)), ModTime: time.Now()})
+	if err == nil {
+		_, err = tw.Write(m)
+	}
+	if err == nil {
+		err = addFile(tw, backupDatabase, tmp.Name())
+	}
+	if err == nil && withLogs {
+		err = filepath.Walk(*flagLogDir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && path == *flagLogDir {
+					return nil
+				}
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(*flagLogDir, path)
+			if err != nil {
+				return err
+			}
+			err = addFile(tw, backupLogs+filepath.ToSlash(rel), path)
+			if os.IsNotExist(err) {
+				// removed in the meantime
+				return nil
+			}
+			return err
+		})
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gw.Close()
+	}
+	return err
+}
+
+// restoreBackup writes the database and logs from a backup to the paths
+// given with -db and -log. If the log directory differs from the one the
+// backup was made with, the runs are updated to point to the new one.
+//
+// The backup is extracted to staging directories next to the database and
+// the log directory first, and only moved into place once it turned out to
+// hold a database, so that a broken backup leaves everything as it was.
+func restoreBackup(r io.Reader, force bool) (manifest, error) {
+	var m manifest
+	if *flagDBDriver != "sqlite3" {
+		return m, errors.New("only SQLite databases can be restored")
+	}
+	if _, err := os.Stat(*flagDatabase); err == nil && !force {
+		return m, fmt.Errorf("%s exists, use -force to overwrite it", *flagDatabase)
+	}
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return m, err
+	}
+	tr := tar.NewReader(gr)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return m, err
+	}
+	if hdr.Name != backupManifest {
+		return m, errors.New("not a runtriggers backup")
+	}
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return m, fmt.Errorf("reading manifest: %v", err)
+	}
+	if m.Version != backupVersion {
+		return m, fmt.Errorf("unsupported backup version %d", m.Version)
+	}
+
+	logDir := filepath.Clean(*flagLogDir)
+	if err := os.MkdirAll(filepath.Dir(logDir), 0755); err != nil {
+		return m, err
+	}
+	dbStaging, err := ioutil.TempDir(filepath.Dir(*flagDatabase), ".runtriggers-restore-")
+	if err != nil {
+		return m, err
+	}
+	defer os.RemoveAll(dbStaging)
+	logStaging, err := ioutil.TempDir(filepath.Dir(logDir), ".runtriggers-restore-logs-")
+	if err != nil {
+		return m, err
+	}
+	defer os.RemoveAll(logStaging)
+
+	tmpDB := filepath.Join(dbStaging, backupDatabase)
+	var haveDB bool
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return m, err
+		}
+
+		var path string
+		switch {
+		case hdr.Name == backupDatabase:
+			path = tmpDB
+			haveDB = true
+		case strings.HasPrefix(hdr.Name, backupLogs) && hdr.Typeflag == tar.TypeReg:
+			rel := filepath.FromSlash(strings.TrimPrefix(hdr.Name, backupLogs))
+			if !filepath.IsLocal(rel) {
+				return m, fmt.Errorf("bad log path %q in backup", hdr.Name)
+			}
+			path = filepath.Join(logStaging, rel)
+		default:
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return m, err
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return m, err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return m, err
+		}
+	}
+	if !haveDB {
+		return m, errors.New("backup has no database")
+	}
+	if err := prepareRestoredDatabase(tmpDB, filepath.Clean(m.LogDir), logDir); err != nil {
+		return m, err
+	}
+
+	err = filepath.Walk(logStaging, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(logStaging, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(logDir, rel)
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		return os.Rename(path, dest)
+	})
+	if err != nil {
+		return m, fmt.Errorf("moving logs into place: %v", err)
+	}
+
+	// SQLite would apply a write-ahead log left by the database replaced to
+	// the restored one
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(*flagDatabase + suffix); err != nil && !os.IsNotExist(err) {
+			return m, err
+		}
+	}
+	return m, os.Rename(tmpDB, *flagDatabase)
+}
+
+// prepareRestoredDatabase checks that the restored file is a runtriggers
+// database, and points the runs' logs from oldLogDir to logDir.
+func prepareRestoredDatabase(path, oldLogDir, logDir string) error {
+	restored, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer restored.Close()
+
+	var version int
+	if err := restored.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return fmt.Errorf("backup has no usable database: %v", err)
+	}
+	if oldLogDir == logDir {
+		return nil
+	}
+	_, err = restored.Exec("UPDATE runs SET log_filename = ? || substr(log_filename, ?) WHERE substr(log_filename, 1, ?) = ?",
+		logDir, len(oldLogDir)+1, len(oldLogDir), oldLogDir)
+	if err != nil {
+		return fmt.Errorf("moving logs: %v", err)
+	}
+	return nil
+}
+
+// backupCommand implements the backup subcommand.
+func backupCommand(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	noLogs := fs.Bool("no-logs", false, "leave run logs out of the backup")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: runtriggers [flags] backup [-no-logs] FILE|-")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	var w io.Writer = os.Stdout
+	if fs.Arg(0) != "-" {
+		f, err := os.Create(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeBackup(w, !*noLogs); err != nil {
+		fmt.Fprintln(os.Stderr, "backup failed:", err)
+		return 1
+	}
+	return 0
+}
+
+// restoreCommand implements the restore subcommand. runtriggers must not
+// be running, it would not notice the restored database.
+func restoreCommand(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	force := fs.Bool("force", false, "overwrite an existing database")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: runtriggers [flags] restore [-force] FILE|-")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	var r io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+	m, err := restoreBackup(r, *force)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "restore failed:", err)
+		return 1
+	}
+	fmt.Printf("restored backup of %s, schema version %d\n", m.Created.Format(time.RFC3339), m.SchemaVersion)
+	if !m.Logs {
+		fmt.Println("the backup has no logs")
+	}
+	return 0
+}
+
+type backupState struct {
+	sync.Mutex
+	last time.Time
+	err  error
+
+	// running is held while a backup is written
+	running sync.Mutex
+}
+
+var backups backupState
+
+func initBackups() {
+	if *flagBackupInterval == 0 {
+		return
+	}
+	if *flagBackupDir == "" {
+		fatal("-backup-interval needs -backup-dir")
+	}
+	readinessChecks["backup"] = checkBackup
+
+	go func() {
+		for range time.Tick(*flagBackupInterval) {
+			if path, err := backupToDir(!cfg().backupNoLogs); err != nil {
+				slog.Error("scheduled backup failed", "err", err)
+			} else {
+				slog.Info("backed up", "path", path)
+			}
+		}
+	}()
+}
+
+func checkBackup() (string, error) {
+	backups.Lock()
+	defer backups.Unlock()
+
+	if backups.err != nil {
+		return "", backups.err
+	}
+	if backups.last.IsZero() {
+		return "no backup yet", nil
+	}
+	return "last backup " + backups.last.Format(time.RFC3339), nil
+}
+
+// backupToDir writes a backup to a new file in the backup directory, and
+// removes the oldest backups there beyond -backup-keep.
+func backupToDir(withLogs bool) (string, error) {
+	backups.running.Lock()
+	defer backups.running.Unlock()
+
+	path, err := writeBackupFile(withLogs)
+	backups.Lock()
+	defer backups.Unlock()
+	backups.err = err
+	if err != nil {
+		return "", err
+	}
+	backups.last = time.Now()
+	return path, nil
+}
+
+func writeBackupFile(withLogs bool) (string, error) {
+	if err := os.MkdirAll(*flagBackupDir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(*flagBackupDir, "runtriggers-"+time.Now().Format("20060102-150405")+".tar.gz")
+	f, err := os.OpenFile(path+".partial", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	err = writeBackup(f, withLogs)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".partial", path)
+	}
+	if err != nil {
+		os.Remove(path + ".partial")
+		return "", err
+	}
+
+	old, err := filepath.Glob(filepath.Join(*flagBackupDir, "runtriggers-*.tar.gz"))
+	if err != nil {
+		return path, err
+	}
+	sort.Strings(old)
+	for keep := cfg().backupKeep; len(old) > keep; {
+		if err := os.Remove(old[0]); err != nil {
+			slog.Warn("failed to remove old backup", "path", old[0], "err", err)
+		}
+		old = old[1:]
+	}
+	return path, nil
+}
+
+// apiBackup makes a backup into the backup directory, for admins to call
+// from e.g. cron. With logs=0, run logs are left out.
+func apiBackup(w http.ResponseWriter, r *http.Request, u user) {
+	if !u.IsAdmin() {
+		http.Error(w, errForbidden.Error(), 403)
+		return
+	}
+	if *flagBackupDir == "" {
+		http.Error(w, "no -backup-dir configured", 409)
+		return
+	}
+
+	withLogs := r.URL.Query().Get("logs") != "0"
+	path, err := backupToDir(withLogs)
+	if err != nil {
+		reqLog(r).Error("backup failed", "err", err)
+		http.Error(w, fmt.Sprintf("backup failed: %s", err), 500)
+		return
+	}
+	audit(r, u, ActionBackup, 0, 0, url.Values{"path": {path}})
+
+	var size int64
+	if fi, err := os.Stat(path); err == nil {
+		size = fi.Size()
+	}
+	writeJSON(w, 200, struct {
+		Path string `json:"path"`
+		Size int64  `json:"size"`
+	}{path, size})
+}
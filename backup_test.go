@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestBackupRestore(t *testing.T) {
+	if os.Getenv("RT_TEST_POSTGRES_DSN") != "" {
+		t.Skip("only SQLite databases are backed up")
+	}
+	testDB(t)
+	dir := t.TempDir()
+
+	oldLogs := filepath.Join(dir, "logs")
+	setFlag(t, flagLogDir, oldLogs)
+	logFile := filepath.Join(oldLogs, "0001", "run.log")
+	os.MkdirAll(filepath.Dir(logFile), 0755)
+	ioutil.WriteFile(logFile, []byte("hello\n"), 0644)
+	if err := db.Create(&Run{ScriptID: 1, RunNo: 1, StartTime: time.Now(), LogFilename: logFile}).Error; err != nil {
+		t.Fatal(err)
+	}
+	var backup bytes.Buffer
+	if err := writeBackup(&backup, true); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(dir, "restore", "runtriggers.db")
+	os.MkdirAll(filepath.Dir(target), 0755)
+	setFlag(t, flagDatabase, target)
+	newLogs := filepath.Join(dir, "restore", "logs")
+	setFlag(t, flagLogDir, newLogs)
+	ioutil.WriteFile(target, []byte("old database"), 0644)
+	ioutil.WriteFile(target+"-wal", []byte("old write-ahead log"), 0644)
+
+	if _, err := restoreBackup(bytes.NewReader(backup.Bytes()), false); err == nil {
+		t.Fatal("existing database overwritten without -force")
+	}
+
+	// a backup without a usable database changes nothing
+	var broken bytes.Buffer
+	gw := gzip.NewWriter(&broken)
+	tw := tar.NewWriter(gw)
+	m, _ := json.Marshal(manifest{Version: backupVersion, LogDir: oldLogs})
+	for _, f := range []struct {
+		name    string
+		content []byte
+	}{
+		{backupManifest, m},
+		{backupDatabase, []byte("not a database")},
+		{backupLogs + "0001/new.log", []byte("clobbered\n")},
+	} {
+		tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), Typeflag: tar.TypeReg})
+		tw.Write(f.content)
+	}
+	tw.Close()
+	gw.Close()
+	if _, err := restoreBackup(&broken, true); err == nil {
+		t.Error("restored a backup without a database")
+	}
+	if content, _ := ioutil.ReadFile(target); string(content) != "old database" {
+		t.Errorf("database replaced by a broken backup: %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(newLogs, "0001", "new.log")); err == nil {
+		t.Error("logs of a broken backup restored")
+	}
+
+	if _, err := restoreBackup(bytes.NewReader(backup.Bytes()), true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(target + "-wal"); !os.IsNotExist(err) {
+		t.Errorf("write-ahead log of the old database left: %v", err)
+	}
+	restoredLog := filepath.Join(newLogs, "0001", "run.log")
+	if content, err := ioutil.ReadFile(restoredLog); err != nil || string(content) != "hello\n" {
+		t.Errorf("restored log: %q, %v", content, err)
+	}
+	entries, _ := ioutil.ReadDir(filepath.Dir(target))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".runtriggers-restore") {
+			t.Errorf("staging directory %s left", e.Name())
+		}
+	}
+
+	restored, err := gorm.Open("sqlite3", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	var run Run
+	if err := restored.First(&run).Error; err != nil || run.LogFilename != restoredLog {
+		t.Errorf("restored run: %+v, %v", run, err)
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	osUser "os/user"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var flagMaxImportSize = flag.Int64("import-max-size", 1<<20, "maximum size in bytes of bundles imported through the web")
+
+const bundleVersion = 1
+
+// Import conflict policies, for scripts in a bundle named like an existing
+// script.
+const (
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+	ConflictRename    = "rename"
+)
+
+var conflictPolicies = []string{ConflictSkip, ConflictOverwrite, ConflictRename}
+
+// secretSettings are left out of bundles unless asked for, so that
+// exports do not hand out credentials of other users' scripts. Incoming
+// webhook URLs are credentials too, anyone knowing them can post.
+var secretSettings = []string{"WebhookURL", "WebhookSecret"}
+
+// bundle is the exchange format of scripts between runtriggers instances.
+// Settings hold the param-tagged fields of Script by field name.
+type bundle struct {
+	Version int            `yaml:"version" json:"version"`
+	Scripts []bundleScript `yaml:"scripts" json:"scripts"`
+}
+
+type bundleScript struct {
+	Name     string                 `yaml:"name" json:"name"`
+	Owner    user                   `yaml:"owner,omitempty" json:"owner,omitempty"`
+	Text     string                 `yaml:"text" json:"text"`
+	Settings map[string]interface{} `yaml:"settings" json:"settings"`
+}
+
+type importResult struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	ID     int    `json:"id,omitempty"`
+	As     string `json:"imported_as,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (r importResult) String() string {
+	switch {
+	case r.Error != "":
+		return fmt.Sprintf("%s: %s", r.Name, r.Error)
+	case r.As != "":
+		return fmt.Sprintf("%s: %s as %s (#%d)", r.Name, r.Action, r.As, r.ID)
+	case r.ID != 0:
+		return fmt.Sprintf("%s: %s (#%d)", r.Name, r.Action, r.ID)
+	default:
+		return fmt.Sprintf("%s: %s", r.Name, r.Action)
+	}
+}
+
+// newBundle makes a bundle of the scripts, with their secrets if asked.
+func newBundle(scripts []*Script, secrets bool) bundle {
+	b := bundle{Version: bundleVersion, Scripts: []bundleScript{}}
+	for _, s := range scripts {
+		bs := bundleScript{
+			Name:     s.Name,
+			Owner:    s.Owner,
+			Text:     s.Text,
+			Settings: make(map[string]interface{}),
+		}
+		v := reflect.ValueOf(s).Elem()
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name := t.Field(i).Name
+			if t.Field(i).Tag.Get("param") == "" || name == "Name" {
+				continue
+			}
+			if !secrets && containsString(secretSettings, name) {
+				continue
+			}
+			bs.Settings[name] = v.Field(i).Interface()
+		}
+		b.Scripts = append(b.Scripts, bs)
+	}
+	return b
+}
+
+func (b bundle) encode(w io.Writer, format string) error {
+	switch format {
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(b); err != nil {
+			return err
+		}
+		return enc.Close()
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(b)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// parseBundle reads a bundle in YAML, or in JSON, which YAML includes.
+func parseBundle(data []byte) (bundle, error) {
+	var b bundle
+	if err := yaml.Unmarshal(data, &b); err != nil {
+		return b, err
+	}
+	if b.Version != bundleVersion {
+		return b, fmt.Errorf("unsupported bundle version %d", b.Version)
+	}
+	return b, nil
+}
+
+// form turns the script's settings into the form the web editor would
+// send for them.
+func (bs bundleScript) form() (url.Values, error) {
+	form := url.Values{"Name": {bs.Name}}
+	t := reflect.TypeOf(Script{})
+	for name, value := range bs.Settings {
+		f, ok := t.FieldByName(name)
+		if !ok || f.Tag.Get("param") == "" || name == "Name" {
+			return nil, fmt.Errorf("unknown setting %s", name)
+		}
+		switch f.Tag.Get("param") {
+		case "bool":
+			b, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("setting %s must be true or false", name)
+			}
+			if b {
+				form.Set(name, "on")
+			}
+		default:
+			if value != nil {
+				form.Set(name, fmt.Sprint(value))
+			}
+		}
+	}
+	return form, nil
+}
+
+// importBundle creates or updates scripts from the bundle. Scripts are
+// matched to existing ones by name; conflict says what to do on a match.
+// New scripts belong to owner, or the owner given in the bundle if empty.
+func importBundle(b bundle, conflict string, owner user, existing []*Script, save func(*Script) error) []importResult {
+	byName := make(map[string]*Script)
+	sort.Slice(existing, func(i, j int) bool { return existing[i].ID < existing[j].ID })
+	for _, s := range existing {
+		if _, ok := byName[s.Name]; !ok {
+			byName[s.Name] = s
+		}
+	}
+
+	var results []importResult
+	for _, bs := range b.Scripts {
+		res := importResult{Name: bs.Name}
+
+		if _, ok := byName[bs.Name]; !ok || conflict == ConflictRename {
+			bs.Settings = newScriptSettings(bs.Settings)
+		}
+		form, err := bs.form()
+		if err != nil {
+			res.Action, res.Error = "failed", err.Error()
+			results = append(results, res)
+			continue
+		}
+
+		s := Script{Owner: owner}
+		if s.Owner == "" {
+			s.Owner = bs.Owner
+		}
+		if old, ok := byName[bs.Name]; ok {
+			switch conflict {
+			case ConflictSkip:
+				res.Action, res.ID = "skipped", old.ID
+				results = append(results, res)
+				continue
+			case ConflictOverwrite:
+				if old.GitPath != "" {
+					res.Action, res.ID, res.Error = "failed", old.ID, "managed in git"
+					results = append(results, res)
+					continue
+				}
+				s = old.Copy()
+				// bundles exported without secrets keep those of the script
+				for _, name := range secretSettings {
+					if _, ok := bs.Settings[name]; !ok {
+						form.Set(name, fmt.Sprint(reflect.ValueOf(s).FieldByName(name).Interface()))
+					}
+				}
+			case ConflictRename:
+				for n := 2; byName[form.Get("Name")] != nil; n++ {
+					form.Set("Name", fmt.Sprintf("%s (%d)", bs.Name, n))
+				}
+				res.As = form.Get("Name")
+			}
+		}
+		if s.Owner == "" {
+			res.Action, res.Error = "failed", "no owner"
+			results = append(results, res)
+			continue
+		}
+
+		s.Text = bs.Text
+		if issues := applyParams(&s, form); len(issues) > 0 {
+			var msgs []string
+			for field, issue := range issues {
+				msgs = append(msgs, field+": "+issue)
+			}
+			sort.Strings(msgs)
+			res.Action, res.Error = "failed", strings.Join(msgs, "; ")
+			results = append(results, res)
+			continue
+		}
+
+		new := s.ID == 0
+		if err := save(&s); err != nil {
+			res.Action, res.Error = "failed", err.Error()
+			results = append(results, res)
+			continue
+		}
+		res.ID = s.ID
+		if new {
+			res.Action = "created"
+			byName[s.Name] = &s
+		} else {
+			res.Action = "updated"
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// selectScripts picks the scripts with the given IDs, or all of them if
+// there are none given.
+func selectScripts(ids []string) ([]*Script, error) {
+	if len(ids) == 0 {
+		scripts := allScripts.get()
+		sort.Slice(scripts, func(i, j int) bool { return scripts[i].ID < scripts[j].ID })
+		return scripts, nil
+	}
+
+	var scripts []*Script
+	for _, v := range ids {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad script ID %q", v)
+		}
+		s, ok := allScripts.lookup(id)
+		if !ok {
+			return nil, fmt.Errorf("no script with ID %d", id)
+		}
+		scripts = append(scripts, s)
+	}
+	return scripts, nil
+}
+
+func exportScripts(w http.ResponseWriter, r *http.Request, u user) {
+	r.ParseForm()
+	format := r.Form.Get("format")
+	if format == "" {
+		format = "yaml"
+	}
+	if format != "yaml" && format != "json" {
+		http.Error(w, "unknown format "+format, 400)
+		return
+	}
+
+	scripts, err := selectScripts(r.Form["id"])
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	secrets := r.Form.Get("secrets") != ""
+	if secrets {
+		for _, s := range scripts {
+			if !u.CanAccessJob(s.Owner) {
+				http.Error(w, fmt.Sprintf("only the owner or an admin can export the secrets of %s", s.Name), 403)
+				return
+			}
+		}
+	}
+
+	if format == "yaml" {
+		w.Header().Set("Content-Type", "application/yaml")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=runtriggers-scripts."+format)
+	if err := newBundle(scripts, secrets).encode(w, format); err != nil {
+		reqLog(r).Error("failed to export scripts", "err", err)
+	}
+}
+
+// importScripts serves the import form of the web interface.
+func importScripts(w http.ResponseWriter, r *http.Request, u user) {
+	flashMessages := getFlashMessages(w, r)
+	var results []importResult
+
+	conflict := ConflictSkip
+	if r.Method == "POST" {
+		r.ParseMultipartForm(*flagMaxImportSize)
+		conflict = r.Form.Get("conflict")
+
+		data := []byte(r.Form.Get("bundle"))
+		if f, _, err := r.FormFile("file"); err == nil {
+			data, err = ioutil.ReadAll(io.LimitReader(f, *flagMaxImportSize))
+			f.Close()
+			if err != nil {
+				flashMessages = append(flashMessages, flashMessage{ID: "error", Args: []string{"Failed to read file: " + err.Error()}})
+			}
+		}
+
+		if b, err := parseBundle(data); err != nil {
+			flashMessages = append(flashMessages, flashMessage{ID: "error", Args: []string{"Bad bundle: " + err.Error()}})
+		} else if !containsString(conflictPolicies, conflict) {
+			flashMessages = append(flashMessages, flashMessage{ID: "error", Args: []string{"Unknown conflict policy"}})
+		} else {
+			results = importBundle(b, conflict, u, allScripts.get(), allScripts.save)
+			auditImport(r, u, results)
+		}
+	}
+
+	execTmpl(w, r, "import", map[string]interface{}{
+		"user":          u,
+		"flashMessages": flashMessages,
+		"results":       results,
+		"conflict":      conflict,
+		"policies":      conflictPolicies,
+	})
+}
+
+// importScriptsX imports the bundle in the request body, for use outside
+// of a browser.
+func importScriptsX(w http.ResponseWriter, r *http.Request) {
+	u := getRequestUser(r)
+	if u == "" {
+		http.Error(w, errForbidden.Error(), 403)
+		return
+	}
+
+	conflict := r.URL.Query().Get("conflict")
+	if conflict == "" {
+		conflict = ConflictSkip
+	}
+	if !containsString(conflictPolicies, conflict) {
+		http.Error(w, "unknown conflict policy "+conflict, 400)
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, *flagMaxImportSize))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	b, err := parseBundle(data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parsing body: %s", err), 400)
+		return
+	}
+
+	results := importBundle(b, conflict, u, allScripts.get(), allScripts.save)
+	auditImport(r, u, results)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func auditImport(r *http.Request, u user, results []importResult) {
+	for _, res := range results {
+		if res.Action == "created" || res.Action == "updated" {
+			audit(r, u, ActionImport, res.ID, 0, url.Values{"Name": {res.Name}, "result": {res.Action}})
+		}
+	}
+}
+
+// bundleCommand implements the export and import subcommands, which work on
+// the database directly. They are meant for when runtriggers is not
+// running, as it would not notice the changes and overwrite them.
+func bundleCommand(command string, args []string) int {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	format := fs.String("format", "yaml", "format of the bundle: yaml or json")
+	conflict := fs.String("conflict", ConflictSkip, "what to do with scripts named like existing ones: skip, overwrite or rename")
+	owner := fs.String("owner", "", "owner of imported scripts (default: as in the bundle)")
+	secrets := fs.Bool("secrets", false, "export secrets such as webhook signing secrets too")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: runtriggers [flags] export [-format yaml|json] [-secrets] [ID...]")
+		fmt.Fprintln(os.Stderr, "       runtriggers [flags] import [-conflict skip|overwrite|rename] [-owner USER] FILE")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	current, err := schemaVersionOf(db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to read schema version:", err)
+		return 1
+	}
+	if current != len(migrations) {
+		fmt.Fprintf(os.Stderr, "schema is at version %d, not %d; run migrate first\n", current, len(migrations))
+		return 1
+	}
+
+	var scripts []*Script
+	if err := db.Order("id").Find(&scripts).Error; err != nil {
+		fmt.Fprintln(os.Stderr, "failed to load scripts:", err)
+		return 1
+	}
+
+	if command == "export" {
+		if fs.NArg() > 0 {
+			ids := make(map[int]bool)
+			for _, v := range fs.Args() {
+				id, err := strconv.Atoi(v)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "bad script ID %q\n", v)
+					return 2
+				}
+				ids[id] = true
+			}
+			var selected []*Script
+			for _, s := range scripts {
+				if ids[s.ID] {
+					selected = append(selected, s)
+					delete(ids, s.ID)
+				}
+			}
+			for id := range ids {
+				fmt.Fprintf(os.Stderr, "no script with ID %d\n", id)
+				return 1
+			}
+			scripts = selected
+		}
+		if err := newBundle(scripts, *secrets).encode(os.Stdout, *format); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	if fs.NArg() != 1 || !containsString(conflictPolicies, *conflict) {
+		fs.Usage()
+		return 2
+	}
+	var data []byte
+	if fs.Arg(0) == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	b, err := parseBundle(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bad bundle:", err)
+		return 1
+	}
+
+	actor := user("")
+	if cur, err := osUser.Current(); err == nil {
+		actor = user(cur.Username)
+	}
+
+	save := func(s *Script) error {
+		if s.ID == 0 {
+			return db.Create(s).Error
+		}
+		return db.Save(s).Error
+	}
+
+	status := 0
+	for _, res := range importBundle(b, *conflict, user(*owner), scripts, save) {
+		fmt.Println(res)
+		if res.Error != "" {
+			status = 1
+		}
+		if res.Action == "created" || res.Action == "updated" {
+			auditAs(actor, "command line", ActionImport, res.ID, url.Values{"Name": {res.Name}, "result": {res.Action}})
+		}
+	}
+	return status
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBundleSecrets(t *testing.T) {
+	old := current
+	current = &settings{admins: map[user]bool{"root": true}}
+	t.Cleanup(func() { current = old })
+
+	s := &Script{ID: 1, Name: "deploy", Owner: "alice", Kind: KindScript, WebhookURL: "https://hooks.example/x", WebhookSecret: "s3cret"}
+	allScripts.scripts[s.ID] = s
+	t.Cleanup(func() { delete(allScripts.scripts, s.ID) })
+
+	for _, name := range []string{"WebhookURL", "WebhookSecret"} {
+		if _, ok := newBundle([]*Script{s}, false).Scripts[0].Settings[name]; ok {
+			t.Errorf("%s exported without asking", name)
+		}
+	}
+	if got := newBundle([]*Script{s}, true).Scripts[0].Settings["WebhookSecret"]; got != "s3cret" {
+		t.Errorf("secret exported as %v", got)
+	}
+
+	for _, tc := range []struct {
+		user   user
+		query  string
+		status int
+		secret bool
+	}{
+		{"bob", "id=1", 200, false},
+		{"bob", "id=1&secrets=1", 403, false},
+		{"alice", "id=1&secrets=1", 200, true},
+		{"root", "id=1&secrets=1", 200, true},
+	} {
+		w := httptest.NewRecorder()
+		exportScripts(w, httptest.NewRequest("GET", "/export?"+tc.query, nil), tc.user)
+		body := w.Body.String()
+		if w.Code != tc.status || strings.Contains(body, "s3cret") != tc.secret || strings.Contains(body, "hooks.example") != tc.secret {
+			t.Errorf("%s %s: status %d, body %q", tc.user, tc.query, w.Code, w.Body)
+		}
+	}
+
+	// importing a bundle without secrets over the script keeps them
+	b := newBundle([]*Script{s}, false)
+	var saved Script
+	results := importBundle(b, ConflictOverwrite, "", []*Script{s}, func(s *Script) error {
+		saved = *s
+		return nil
+	})
+	if len(results) != 1 || results[0].Action != "updated" || saved.WebhookSecret != "s3cret" || saved.WebhookURL != s.WebhookURL {
+		t.Errorf("import: %v, webhook %q, secret %q", results, saved.WebhookURL, saved.WebhookSecret)
+	}
+}
@@ -0,0 +1,509 @@
+// Command rtctl is a command line client for runtriggers, talking to its
+// JSON API.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	flagServer     = flag.String("server", envOr("RUNTRIGGERS_URL", "http://127.0.0.1:80"), "URL of runtriggers, including the base path, or unix:PATH for a unix socket ($RUNTRIGGERS_URL)")
+	flagUser       = flag.String("user", os.Getenv("RUNTRIGGERS_USER"), "user to act as ($RUNTRIGGERS_USER); with $RUNTRIGGERS_PASSWORD set it logs in with HTTP Basic auth, otherwise it is sent in the -auth-header header")
+	flagAuthHeader = flag.String("auth-header", "X-Forwarded-User", "request header carrying the username, for runtriggers using header authentication")
+)
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// The records sent by the API, with the fields rtctl uses.
+
+type script struct {
+	ID                   int        `json:"id"`
+	Name                 string     `json:"name"`
+	Owner                string     `json:"owner"`
+	Kind                 string     `json:"kind"`
+	PeriodicRunsEnabled  bool       `json:"periodic_runs_enabled"`
+	RunPeriod            string     `json:"run_period"`
+	ScheduledRunsEnabled bool       `json:"scheduled_runs_enabled"`
+	Scheduled            *time.Time `json:"scheduled"`
+	GitPath              string     `json:"git_path"`
+	Running              bool       `json:"running"`
+	LastRun              *run       `json:"last_run"`
+}
+
+type run struct {
+	RunNo       int                 `json:"run_no"`
+	State       string              `json:"state"`
+	Cause       string              `json:"cause"`
+	TriggeredBy string              `json:"triggered_by"`
+	StartTime   time.Time           `json:"start_time"`
+	Duration    *float64            `json:"duration_seconds"`
+	ExitCode    *int                `json:"exit_code"`
+	Params      map[string][]string `json:"params"`
+}
+
+type client struct {
+	base string
+	http *http.Client
+}
+
+func newClient() *client {
+	c := &client{base: strings.TrimRight(*flagServer, "/"), http: &http.Client{}}
+	if strings.HasPrefix(c.base, "unix:") {
+		path := strings.TrimPrefix(c.base, "unix:")
+		c.base = "http://runtriggers"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+	}
+	return c
+}
+
+// do sends a request to the API and returns the response if its status
+// is a success, the body of the response is the error otherwise.
+func (c *client) do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base+"/api"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if password := os.Getenv("RUNTRIGGERS_PASSWORD"); password != "" {
+		req.SetBasicAuth(*flagUser, password)
+	} else if *flagUser != "" {
+		req.Header.Set(*flagAuthHeader, *flagUser)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (c *client) getJSON(path string, v interface{}) error {
+	resp, err := c.do("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// lookup finds a script by its ID or name.
+func (c *client) lookup(nameOrID string) (script, error) {
+	var s script
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return s, c.getJSON(fmt.Sprintf("/scripts/%d", id), &s)
+	}
+
+	var scripts []script
+	if err := c.getJSON("/scripts", &scripts); err != nil {
+		return s, err
+	}
+	var found []script
+	for _, s := range scripts {
+		if s.Name == nameOrID {
+			found = append(found, s)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return s, fmt.Errorf("no script named %q", nameOrID)
+	case 1:
+		return found[0], nil
+	default:
+		return s, fmt.Errorf("%d scripts are named %q, use the ID", len(found), nameOrID)
+	}
+}
+
+// lastRun returns the number of the script's latest run.
+func (c *client) lastRun(s script) (int, error) {
+	if s.LastRun == nil {
+		return 0, fmt.Errorf("script %q has no runs", s.Name)
+	}
+	return s.LastRun.RunNo, nil
+}
+
+// printLog writes the log of a run to stdout, following it until the run
+// ends if follow is set.
+func (c *client) printLog(s script, runNo int, follow bool) error {
+	path := fmt.Sprintf("/scripts/%d/runs/%d/log", s.ID, runNo)
+	if follow {
+		path += "?follow=1"
+	}
+	resp, err := c.do("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func formatRun(r *run) string {
+	if r == nil {
+		return "-"
+	}
+	s := fmt.Sprintf("#%d %s", r.RunNo, r.State)
+	if r.ExitCode != nil && *r.ExitCode != 0 {
+		s += fmt.Sprintf(" (code %d)", *r.ExitCode)
+	}
+	return s
+}
+
+func cmdList(c *client, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	var scripts []script
+	if err := c.getJSON("/scripts", &scripts); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tOWNER\tKIND\tPERIOD\tSCHEDULED\tLAST RUN")
+	for _, s := range scripts {
+		period := "-"
+		if s.PeriodicRunsEnabled {
+			period = s.RunPeriod
+		}
+		scheduled := "-"
+		if s.ScheduledRunsEnabled {
+			scheduled = formatTime(s.Scheduled)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.Name, s.Owner, s.Kind, period, scheduled, formatRun(s.LastRun))
+	}
+	return tw.Flush()
+}
+
+func cmdRuns(c *client, args []string) error {
+	fs := flag.NewFlagSet("runs", flag.ContinueOnError)
+	n := fs.Int("n", 20, "number of runs to show")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+	s, err := c.lookup(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var runs []run
+	if err := c.getJSON(fmt.Sprintf("/scripts/%d/runs?limit=%d", s.ID, *n), &runs); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN\tSTATE\tCODE\tCAUSE\tSTART\tDURATION\tPARAMETERS")
+	for _, r := range runs {
+		code, duration := "-", "-"
+		if r.ExitCode != nil {
+			code = strconv.Itoa(*r.ExitCode)
+			duration = (time.Duration(*r.Duration * float64(time.Second))).Round(time.Millisecond).String()
+		}
+		cause := r.Cause
+		if r.TriggeredBy != "" {
+			cause += " by " + r.TriggeredBy
+		}
+		var params []string
+		for name, values := range r.Params {
+			params = append(params, name+"="+strings.Join(values, ","))
+		}
+		sort.Strings(params)
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", r.RunNo, r.State, code, cause, formatTime(&r.StartTime), duration, strings.Join(params, " "))
+	}
+	return tw.Flush()
+}
+
+// paramFlags collects repeated -p NAME=VALUE flags.
+type paramFlags map[string]string
+
+func (p paramFlags) String() string {
+	return ""
+}
+
+func (p paramFlags) Set(v string) error {
+	idx := strings.IndexByte(v, '=')
+	if idx <= 0 {
+		return errors.New("parameter must be NAME=VALUE")
+	}
+	p[v[:idx]] = v[idx+1:]
+	return nil
+}
+
+func cmdRun(c *client, args []string) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	params := paramFlags{}
+	fs.Var(params, "p", "run parameter NAME=VALUE, passed to the script as the environment variable RT_PARAM_NAME (repeatable)")
+	follow := fs.Bool("f", false, "follow the run's log and exit with its exit code")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+	s, err := c.lookup(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	body, _ := json.Marshal(struct {
+		Params map[string]string `json:"params,omitempty"`
+	}{params})
+	resp, err := c.do("PUT", fmt.Sprintf("/scripts/%d/run", s.ID), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	var started struct {
+		RunNo  int  `json:"run_no"`
+		Queued bool `json:"queued"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&started)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if started.Queued {
+		fmt.Fprintf(os.Stderr, "script %q is running, the run starts after it\n", s.Name)
+		return nil
+	}
+	if !*follow {
+		fmt.Printf("started run #%d of %q\n", started.RunNo, s.Name)
+		return nil
+	}
+
+	if err := c.printLog(s, started.RunNo, true); err != nil {
+		return err
+	}
+	var r run
+	if err := c.getJSON(fmt.Sprintf("/scripts/%d/runs/%d", s.ID, started.RunNo), &r); err != nil {
+		return err
+	}
+	if r.State != "done" {
+		code := 1
+		if r.ExitCode != nil && *r.ExitCode > 0 {
+			code = *r.ExitCode
+		}
+		return exitCode(code)
+	}
+	return nil
+}
+
+func cmdLog(c *client, args []string) error {
+	fs := flag.NewFlagSet("log", flag.ContinueOnError)
+	follow := fs.Bool("f", false, "follow the log until the run ends")
+	if err := fs.Parse(args); err != nil || fs.NArg() < 1 || fs.NArg() > 2 {
+		return errUsage
+	}
+	s, err := c.lookup(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var runNo int
+	if fs.NArg() == 2 {
+		if runNo, err = strconv.Atoi(strings.TrimPrefix(fs.Arg(1), "#")); err != nil {
+			return errUsage
+		}
+	} else if runNo, err = c.lastRun(s); err != nil {
+		return err
+	}
+	return c.printLog(s, runNo, *follow)
+}
+
+func cmdSchedule(c *client, args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	s, err := c.lookup(args[0])
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do("PUT", fmt.Sprintf("/scripts/%d/schedule", s.ID), strings.NewReader(strings.Join(args[1:], " ")))
+	if err != nil {
+		return err
+	}
+	var scheduled struct {
+		Scheduled time.Time `json:"scheduled"`
+		Enabled   bool      `json:"scheduled_runs_enabled"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&scheduled)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("scheduled %q for %s\n", s.Name, formatTime(&scheduled.Scheduled))
+	if !scheduled.Enabled {
+		fmt.Fprintln(os.Stderr, "note: scheduled runs are disabled for the script, it will not run until they are enabled")
+	}
+	return nil
+}
+
+func cmdUnschedule(c *client, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	s, err := c.lookup(args[0])
+	if err != nil {
+		return err
+	}
+	resp, err := c.do("DELETE", fmt.Sprintf("/scripts/%d/schedule", s.ID), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+var signals = map[string]syscall.Signal{
+	"INT":  syscall.SIGINT,
+	"TERM": syscall.SIGTERM,
+	"KILL": syscall.SIGKILL,
+}
+
+func cmdKill(c *client, args []string) error {
+	fs := flag.NewFlagSet("kill", flag.ContinueOnError)
+	signal := fs.String("s", "TERM", "signal to send: INT, TERM or KILL")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(*signal), "SIG")]
+	if !ok {
+		return fmt.Errorf("unsupported signal %s", *signal)
+	}
+	s, err := c.lookup(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	resp, err := c.do("PUT", fmt.Sprintf("/scripts/%d/kill/%d", s.ID, int(sig)), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func cmdPush(c *client, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	s, err := c.lookup(args[0])
+	if err != nil {
+		return err
+	}
+
+	var text []byte
+	if args[1] == "-" {
+		text, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		text, err = ioutil.ReadFile(args[1])
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do("PUT", fmt.Sprintf("/scripts/%d/text", s.ID), bytes.NewReader(text))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	fmt.Printf("updated the text of %q\n", s.Name)
+	return nil
+}
+
+var errUsage = errors.New("usage")
+
+// exitCode is returned by commands which exit with a status other than 1
+// without an error message.
+type exitCode int
+
+func (e exitCode) Error() string {
+	return "exit code " + strconv.Itoa(int(e))
+}
+
+var commands = []struct {
+	name  string
+	args  string
+	about string
+	run   func(*client, []string) error
+}{
+	{"list", "", "list scripts", cmdList},
+	{"runs", "[-n N] SCRIPT", "show the latest runs of a script", cmdRuns},
+	{"run", "[-f] [-p NAME=VALUE]... SCRIPT", "trigger a run, optionally with parameters and following its log", cmdRun},
+	{"log", "[-f] SCRIPT [RUN]", "show the log of a run, the latest by default", cmdLog},
+	{"schedule", "SCRIPT TIME", "schedule a run, at e.g. \"now +1h\" or \"2024-06-01T12:00:00Z -5m\"", cmdSchedule},
+	{"unschedule", "SCRIPT", "clear the scheduled run", cmdUnschedule},
+	{"kill", "[-s INT|TERM|KILL] SCRIPT", "send a signal to the running script", cmdKill},
+	{"push", "SCRIPT FILE|-", "replace the text of a script with a local file", cmdPush},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: rtctl [flags] COMMAND [ARGS]\n\nSCRIPT is a script's ID or name. Commands:\n\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s %s\n    \t%s\n", cmd.name, cmd.args, cmd.about)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != flag.Arg(0) {
+			continue
+		}
+		err := cmd.run(newClient(), flag.Args()[1:])
+		var code exitCode
+		switch {
+		case err == nil:
+			return
+		case errors.Is(err, errUsage):
+			fmt.Fprintf(os.Stderr, "usage: rtctl %s %s\n", cmd.name, cmd.args)
+			os.Exit(2)
+		case errors.As(err, &code):
+			os.Exit(int(code))
+		default:
+			fmt.Fprintf(os.Stderr, "rtctl %s: %s\n", cmd.name, err)
+			os.Exit(1)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "rtctl: unknown command %q\n", flag.Arg(0))
+	usage()
+	os.Exit(2)
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	flagConfig = flag.String("config", "", "path to a YAML configuration file, with the flags' names as keys; flags given on the command line override it")
+)
+
+// The configuration file sets flags, and in script-defaults, the settings
+// new scripts start with:
+//
+//	listen: 127.0.0.1:8080
+//	admins: [alice, bob]
+//	email-retries: 5
+//	script-defaults:
+//	  NotifyOnFailure: true
+//	  EmailAddress: ops@example.com
+//
+// On SIGHUP, runtriggers reads it again and takes over the flags listed in
+// reloadableFlags and the script defaults. Other flags only take effect on
+// a restart.
+//
+// The flag variables are only set on startup. The values of the reloadable
+// flags are read through cfg(), which returns them as of the last reload.
+
+const scriptDefaultsKey = "script-defaults"
+
+var reloadableFlags = []string{
+	"admins",
+	"log-level",
+	"email", "email-transport", "email-from", "email-reply-to",
+	"email-retries", "email-retry-delay", "email-attach-log", "email-attach-log-limit",
+	"smtp-server", "smtp-tls", "smtp-user", "smtp-password-file",
+	"notify-templates", "notify-log-lines",
+	"webhook-retries", "webhook-retry-delay", "webhook-log-lines",
+	"backup-keep", "backup-no-logs",
+}
+
+// Flags which make no sense in the configuration file.
+var unconfigurableFlags = []string{"config", "mockuser"}
+
+// configM guards current.
+var configM sync.RWMutex
+
+// settings are the values of the reloadable flags, and what comes of them.
+// They are replaced as a whole on reload, and never changed once in use.
+type settings struct {
+	logLevel slog.Level
+	admins   map[user]bool
+
+	emailProgram, emailTransport    string
+	smtpServer, smtpTLS, smtpUser   string
+	smtpPasswordFile                string
+	transport                       mailTransport
+	emailFrom, emailReplyTo         string
+	emailRetries                    int
+	emailRetryDelay                 time.Duration
+	emailAttachLog                  bool
+	emailAttachLogLimit             int
+	notifyTemplates                 string
+	notifyLogLines                  int
+	webhookRetries, webhookLogLines int
+	webhookRetryDelay               time.Duration
+	backupKeep                      int
+	backupNoLogs                    bool
+
+	scriptDefaults map[string]interface{}
+}
+
+var current *settings
+
+// cfg returns the current values of the reloadable settings.
+func cfg() *settings {
+	configM.RLock()
+	defer configM.RUnlock()
+	return current
+}
+
+// newSettings makes settings from the values of the reloadable flags, as
+// value returns them typed like the flags.
+func newSettings(value func(name string) interface{}, scriptDefaults map[string]interface{}) (*settings, error) {
+	s := &settings{
+		emailProgram:        value("email").(string),
+		emailTransport:      value("email-transport").(string),
+		smtpServer:          value("smtp-server").(string),
+		smtpTLS:             value("smtp-tls").(string),
+		smtpUser:            value("smtp-user").(string),
+		smtpPasswordFile:    value("smtp-password-file").(string),
+		emailFrom:           value("email-from").(string),
+		emailReplyTo:        value("email-reply-to").(string),
+		emailRetries:        value("email-retries").(int),
+		emailRetryDelay:     value("email-retry-delay").(time.Duration),
+		emailAttachLog:      value("email-attach-log").(bool),
+		emailAttachLogLimit: value("email-attach-log-limit").(int),
+		notifyTemplates:     value("notify-templates").(string),
+		notifyLogLines:      value("notify-log-lines").(int),
+		webhookRetries:      value("webhook-retries").(int),
+		webhookRetryDelay:   value("webhook-retry-delay").(time.Duration),
+		webhookLogLines:     value("webhook-log-lines").(int),
+		backupKeep:          value("backup-keep").(int),
+		backupNoLogs:        value("backup-no-logs").(bool),
+		scriptDefaults:      scriptDefaults,
+	}
+	if err := s.logLevel.UnmarshalText([]byte(value("log-level").(string))); err != nil {
+		return nil, fmt.Errorf("bad log-level: %v", err)
+	}
+	s.admins = parseUsers(value("admins").(string))
+	t, err := newTransport(s)
+	if err != nil {
+		return nil, err
+	}
+	s.transport = t
+	return s, nil
+}
+
+// flagValue returns the value of the flag, typed.
+func flagValue(name string) interface{} {
+	return flag.Lookup(name).Value.(flag.Getter).Get()
+}
+
+// parseFlagValue parses s as a value of the flag, without setting it.
+func parseFlagValue(name, s string) (interface{}, error) {
+	switch flagValue(name).(type) {
+	case string:
+		return s, nil
+	case int:
+		return strconv.Atoi(s)
+	case bool:
+		return strconv.ParseBool(s)
+	case time.Duration:
+		return time.ParseDuration(s)
+	default:
+		return nil, fmt.Errorf("flag %s cannot be reloaded", name)
+	}
+}
+
+func initSettings() {
+	s, err := newSettings(flagValue, loadedConfig.scriptDefaults)
+	if err != nil {
+		fatal("bad settings", "err", err)
+	}
+	current = s
+}
+
+type config struct {
+	flags          map[string]string
+	scriptDefaults map[string]interface{}
+}
+
+var (
+	// loadedConfig is the configuration file as last read.
+	loadedConfig config
+	// commandLineFlags are the flags given on the command line, which the
+	// configuration file does not override.
+	commandLineFlags = make(map[string]bool)
+)
+
+// readConfig reads and checks the configuration file.
+func readConfig(path string) (config, error) {
+	c := config{flags: make(map[string]string)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return c, err
+	}
+
+	for key, value := range raw {
+		if key == scriptDefaultsKey {
+			defaults, ok := value.(map[string]interface{})
+			if !ok && value != nil {
+				return c, fmt.Errorf("%s must be a mapping of script settings", key)
+			}
+			if err := checkScriptDefaults(defaults); err != nil {
+				return c, fmt.Errorf("%s: %v", key, err)
+			}
+			c.scriptDefaults = defaults
+			continue
+		}
+		if flag.Lookup(key) == nil || containsString(unconfigurableFlags, key) {
+			return c, fmt.Errorf("unknown setting %s", key)
+		}
+		s, err := configValue(value)
+		if err != nil {
+			return c, fmt.Errorf("%s: %v", key, err)
+		}
+		c.flags[key] = s
+	}
+	return c, nil
+}
+
+// configValue turns a value from the configuration file into a flag's
+// argument. Lists become comma-separated.
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(s, ",") {
+				return "", fmt.Errorf("list item %q contains a comma", s)
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+func checkScriptDefaults(defaults map[string]interface{}) error {
+	form, err := bundleScript{Name: "defaults", Settings: defaults}.form()
+	if err != nil {
+		return err
+	}
+	var s Script
+	issues := applyParams(&s, form)
+	if len(issues) == 0 {
+		return nil
+	}
+	var msgs []string
+	for field, issue := range issues {
+		msgs = append(msgs, field+": "+issue)
+	}
+	sort.Strings(msgs)
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// loadConfig reads the configuration file, if any, and sets the flags it
+// has but the command line not, before anything else looks at them.
+func loadConfig() {
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+	if *flagConfig == "" {
+		return
+	}
+
+	c, err := readConfig(*flagConfig)
+	if err != nil {
+		fatal("failed to read the configuration file", "path", *flagConfig, "err", err)
+	}
+	for name, value := range c.flags {
+		if commandLineFlags[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			fatal("bad configuration file", "path", *flagConfig, "err", fmt.Errorf("bad value %q for %s: %v", value, name, err))
+		}
+	}
+	loadedConfig = c
+}
+
+// reloadConfig reads the configuration file again and applies what can
+// change while running. On error, the configuration stays as it was.
+func reloadConfig() error {
+	loadTemplates()
+	if serverCert != nil {
+		serverCert.reloadIfChanged()
+	}
+	if *flagConfig == "" {
+		return nil
+	}
+
+	c, err := readConfig(*flagConfig)
+	if err != nil {
+		return err
+	}
+	for name, value := range c.flags {
+		if !containsString(reloadableFlags, name) && !commandLineFlags[name] && value != loadedConfig.flags[name] {
+			slog.Warn("changed setting takes effect only on restart", "setting", name)
+		}
+	}
+
+	s, err := reloadedSettings(c)
+	if err != nil {
+		return err
+	}
+
+	logLevel.Set(s.logLevel)
+	db.LogMode(s.logLevel <= slog.LevelDebug)
+	configM.Lock()
+	current = s
+	configM.Unlock()
+	loadedConfig = c
+	return nil
+}
+
+// reloadedSettings makes settings from the configuration file. Flags given
+// on the command line keep their values, and those the file leaves out go
+// back to their defaults.
+func reloadedSettings(c config) (*settings, error) {
+	values := make(map[string]interface{})
+	for _, name := range reloadableFlags {
+		if commandLineFlags[name] {
+			values[name] = flagValue(name)
+			continue
+		}
+		s, ok := c.flags[name]
+		if !ok {
+			s = flag.Lookup(name).DefValue
+		}
+		v, err := parseFlagValue(name, s)
+		if err != nil {
+			return nil, fmt.Errorf("bad value %q for %s: %v", s, name, err)
+		}
+		values[name] = v
+	}
+	return newSettings(func(name string) interface{} { return values[name] }, c.scriptDefaults)
+}
+
+// reloadOnSignal reloads the configuration on every SIGHUP.
+func reloadOnSignal() {
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGHUP)
+	for range sigch {
+		if err := reloadConfig(); err != nil {
+			slog.Error("failed to reload the configuration, keeping the old one", "path", *flagConfig, "err", err)
+			continue
+		}
+		slog.Info("reloaded the configuration", "path", *flagConfig)
+	}
+}
+
+// newScriptSettings returns the script defaults from the configuration
+// file, merged into settings, which take precedence.
+func newScriptSettings(settings map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{})
+	for name, value := range cfg().scriptDefaults {
+		merged[name] = value
+	}
+	for name, value := range settings {
+		merged[name] = value
+	}
+	return merged
+}
+
+// defaultScript returns a new script with the default settings.
+func defaultScript(owner user) Script {
+	s := Script{Owner: owner}
+	settings := newScriptSettings(nil)
+	if len(settings) == 0 {
+		return s
+	}
+	form, err := bundleScript{Name: "defaults", Settings: settings}.form()
+	if err != nil {
+		// checked when reading the configuration
+		return s
+	}
+	applyParams(&s, form)
+	s.Name = ""
+	return s
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigSettings(t *testing.T) {
+	c, err := readConfig(writeConfig(t, `
+admins: [alice, bob]
+email-retries: 5
+email-retry-delay: 2m
+email-attach-log: true
+script-defaults:
+  EmailAddress: ops@example.com
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := reloadedSettings(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.admins["alice"] || !s.admins["bob"] || s.admins["carol"] {
+		t.Errorf("admins %v", s.admins)
+	}
+	if s.emailRetries != 5 || s.emailRetryDelay != 2*time.Minute || !s.emailAttachLog {
+		t.Errorf("email settings %d %s %t", s.emailRetries, s.emailRetryDelay, s.emailAttachLog)
+	}
+	if s.webhookRetries != 3 {
+		t.Errorf("webhook-retries %d, want the default 3", s.webhookRetries)
+	}
+	if s.scriptDefaults["EmailAddress"] != "ops@example.com" {
+		t.Errorf("script defaults %v", s.scriptDefaults)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, content := range []string{
+		"bogus: 1\n",
+		"config: other.yaml\n",
+		"admins: [\"a,b\"]\n",
+		"script-defaults:\n  Kind: nonsense\n",
+		"script-defaults: [1]\n",
+	} {
+		if _, err := readConfig(writeConfig(t, content)); err == nil {
+			t.Errorf("%q accepted", content)
+		}
+	}
+
+	for _, content := range []string{
+		"email-retries: many\n",
+		"log-level: loud\n",
+		"email-transport: carrier-pigeon\n",
+	} {
+		c, err := readConfig(writeConfig(t, content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reloadedSettings(c); err == nil {
+			t.Errorf("%q accepted", content)
+		}
+	}
+}
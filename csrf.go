@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/csrf"
+)
+
+var (
+	flagCSRFKey       = flag.String("csrf-key", "", "path to a file with a 32-byte key for signing CSRF cookies (a random key is generated on startup if not given)")
+	flagSecureCookies = flag.Bool("secure-cookies", false, "send cookies only over HTTPS connections")
+)
+
+func loadCSRFKey() []byte {
+	key := make([]byte, 32)
+
+	if *flagCSRFKey == "" {
+		if _, err := rand.Read(key); err != nil {
+			fatal("failed to generate CSRF key", "err", err)
+		}
+		return key
+	}
+
+	content, err := ioutil.ReadFile(*flagCSRFKey)
+	if err != nil {
+		fatal("failed to read CSRF key", "err", err)
+	}
+	if len(content) < len(key) {
+		fatal("CSRF key too short", "path", *flagCSRFKey, "min_bytes", len(key))
+	}
+	copy(key, content)
+	return key
+}
+
+// trustedOrigins returns the hosts other than the request's Host which
+// browser requests are allowed to originate from. When runtriggers runs
+// behind a reverse proxy, the host in the backlink is the one users see.
+func trustedOrigins() []string {
+	if *flagBacklink == "" {
+		return nil
+	}
+	base, err := url.Parse(*flagBacklink)
+	if err != nil || base.Host == "" {
+		return nil
+	}
+	return []string{base.Host}
+}
+
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// not a browser
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, host := range trustedOrigins() {
+		if strings.EqualFold(u.Host, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func csrfFailure(w http.ResponseWriter, r *http.Request) {
+	reqLog(r).Warn("request rejected by CSRF protection", "path", r.URL.Path, "err", csrf.FailureReason(r))
+	http.Error(w, fmt.Sprintf("forbidden: %s", csrf.FailureReason(r)), 403)
+}
+
+// csrfProtect wraps handlers serving the browser UI so that every request
+// with a non-safe method has to carry the token from csrfField.
+func csrfProtect() func(http.Handler) http.Handler {
+	protect := csrf.Protect(
+		loadCSRFKey(),
+		csrf.Path(Link("/")),
+		csrf.Secure(*flagSecureCookies),
+		csrf.SameSite(csrf.SameSiteStrictMode),
+		csrf.TrustedOrigins(trustedOrigins()),
+		csrf.ErrorHandler(http.HandlerFunc(csrfFailure)),
+	)
+
+	return func(h http.Handler) http.Handler {
+		protected := protect(h)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil && r.Header.Get("X-Forwarded-Proto") != "https" {
+				r = csrf.PlaintextHTTPRequest(r)
+			}
+			protected.ServeHTTP(w, r)
+		})
+	}
+}
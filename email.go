@@ -1,20 +1,53 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"text/template"
+	"time"
 )
 
 var (
 	flagEmailProgram = flag.String("email", "", "name of a program through which to send out email")
 	flagBacklink     = flag.String("backlink", "", "base link to this instance to use in email texts (without the path prefix)")
+
+	flagEmailTransport  = flag.String("email-transport", "", "how to send out email: program (pipe into the -email program) or smtp; chosen by which of -email and -smtp-server is set if empty")
+	flagEmailFrom       = flag.String("email-from", "", "From address of notification emails (default runtriggers@<hostname>)")
+	flagEmailReplyTo    = flag.String("email-reply-to", "", "Reply-To address of notification emails")
+	flagEmailRetries    = flag.Int("email-retries", 3, "number of times to retry sending an email")
+	flagEmailRetryDelay = flag.Duration("email-retry-delay", time.Minute, "delay before the first retry, doubled on each further retry")
+	flagEmailAttachLog  = flag.Bool("email-attach-log", false, "attach the gzip-compressed log of the run to emails about anomalous and interrupted runs")
+	flagEmailLogLimit   = flag.Int("email-attach-log-limit", 1<<20, "maximum size of the compressed log attachment in bytes, larger logs are left out")
+
+	flagSMTPServer       = flag.String("smtp-server", "", "host:port of an SMTP server to send email through")
+	flagSMTPTLS          = flag.String("smtp-tls", "starttls", "SMTP connection security: none, starttls or tls")
+	flagSMTPUser         = flag.String("smtp-user", "", "username for SMTP authentication")
+	flagSMTPPasswordFile = flag.String("smtp-password-file", "", "path to a file with the password for SMTP authentication")
 )
 
 func backLink(p string) string {
@@ -23,92 +56,410 @@ func backLink(p string) string {
 	return base.String()
 }
 
-const tmplAnomalous = `Content-Type: text/plain; charset=utf-8
-Subject: =?utf-8?B?{{ .script.Name | printf "%q anomalous" | base64 }}?=
+var emailFuncs template.FuncMap = template.FuncMap{
+	"sh":             Sh,
+	"backlink":       backLink,
+	"FormatDuration": FormatDuration,
+}
 
-Hello!
+var errLogTooLarge = errors.New("log too large")
 
-Run #{{ .script.RunCounter }} of your script {{ .script.Name | printf "%q" }} exited with non-zero exit code.
+type attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
 
-Run time: {{ .run.Duration | FormatDuration }}
-Log: {{ printf "/scripts/%d/logs/%d" .script.ID .script.RunCounter | backlink }}
-Script: {{ printf "/scripts/%d" .script.ID | backlink }}
+type email struct {
+	To          []*mail.Address
+	Subject     string
+	Body        string
+	Attachments []attachment
+}
 
-This is an automatic email.
-`
+// limitedBuffer refuses writes beyond its limit.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
 
-const tmplInterrupted = `Content-Type: text/plain; charset=utf-8
-Subject: =?utf-8?B?{{ .script.Name | printf "%q interrupted" | base64 }}?=
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, errLogTooLarge
+	}
+	return b.Buffer.Write(p)
+}
 
-Hello!
+// compressLog gzips the log file, giving up once the compressed size
+// exceeds the limit.
+func compressLog(filename string, limit int) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-Run #{{ .script.RunCounter }} of your script {{ .script.Name | printf "%q" }} has been interrupted.
+	b := &limitedBuffer{limit: limit}
+	zw := gzip.NewWriter(b)
+	zw.Name = filepath.Base(filename)
+	if _, err = io.Copy(zw, f); err != nil {
+		return nil, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
 
-Script: {{ printf "/scripts/%d" .script.ID | backlink }}
+// attachLog adds the run's log to the email, or a note on why it is left
+// out.
+func (m *email) attachLog(s Script, r Run) {
+	limit := cfg().emailAttachLogLimit
+	data, err := compressLog(r.LogFilename, limit)
+	if err == errLogTooLarge {
+		m.Body += fmt.Sprintf("\nThe log is not attached, it is larger than %d bytes compressed.\n", limit)
+		return
+	}
+	if err != nil {
+		s.logger().Warn("not attaching log to email", "run_no", r.RunNo, "err", err)
+		return
+	}
+	m.Attachments = append(m.Attachments, attachment{
+		Filename:    fmt.Sprintf("script-%d-run-%d.log.gz", s.ID, r.RunNo),
+		ContentType: "application/gzip",
+		Data:        data,
+	})
+}
 
-This is an automatic email.
-`
+// parseEmail splits the output of a notification template into the subject
+// and the body.
+func parseEmail(to string, text []byte) (*email, error) {
+	rcpts, err := mail.ParseAddressList(to)
+	if err != nil {
+		return nil, fmt.Errorf("bad recipient list %q: %s", to, err)
+	}
 
-var emailFuncs template.FuncMap = template.FuncMap{
-	"sh":             Sh,
-	"backlink":       backLink,
-	"FormatDuration": FormatDuration,
-	"base64":         func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(text)))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("reading template headers: %s", err)
+	}
+	body, err := ioutil.ReadAll(r.R)
+	if err != nil {
+		return nil, err
+	}
+
+	return &email{
+		To:      rcpts,
+		Subject: header.Get("Subject"),
+		Body:    string(body),
+	}, nil
 }
 
-func notifyAnomalous(s Script, r Run) {
-	t, err := template.New("").Funcs(emailFuncs).Parse(tmplAnomalous)
-	if err != nil {
-		log.Printf("email notify: failed to parse template: %s", err)
-		return
+func emailFrom() *mail.Address {
+	if from := cfg().emailFrom; from != "" {
+		if addr, err := mail.ParseAddress(from); err == nil {
+			return addr
+		}
 	}
+	hostname, _ := os.Hostname()
+	return &mail.Address{Name: "Runtriggers", Address: "runtriggers@" + hostname}
+}
+
+func messageID(from *mail.Address) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	domain := from.Address[strings.LastIndexByte(from.Address, '@')+1:]
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(b), domain)
+}
+
+func formatAddressList(addrs []*mail.Address) string {
+	var formatted []string
+	for _, addr := range addrs {
+		formatted = append(formatted, addr.String())
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// compose renders the email as an RFC 5322 message. Emails with
+// attachments are sent as multipart/mixed.
+func (m *email) compose(from *mail.Address) []byte {
 	var b bytes.Buffer
-	err = t.Execute(&b, map[string]interface{}{
-		"script": s,
-		"run":    r,
+
+	header := func(name, value string) {
+		fmt.Fprintf(&b, "%s: %s\r\n", name, value)
+	}
+	header("From", from.String())
+	header("To", formatAddressList(m.To))
+	if replyTo := cfg().emailReplyTo; replyTo != "" {
+		header("Reply-To", replyTo)
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", messageID(from))
+	header("Auto-Submitted", "auto-generated")
+	header("MIME-Version", "1.0")
+
+	if len(m.Attachments) == 0 {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		b.WriteString("\r\n")
+		writeQuotedPrintable(&b, m.Body)
+		return b.Bytes()
+	}
+
+	mw := multipart.NewWriter(&b)
+	header("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}))
+	b.WriteString("\r\n")
+
+	part, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
 	})
-	if err != nil {
-		log.Printf("email notify: failed to execute template: %s", err)
-		return
+	writeQuotedPrintable(part, m.Body)
+
+	for _, a := range m.Attachments {
+		part, _ = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(a.ContentType, map[string]string{"name": a.Filename})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		writeBase64(part, a.Data)
+	}
+	mw.Close()
+
+	return b.Bytes()
+}
+
+func writeQuotedPrintable(w io.Writer, text string) {
+	qp := quotedprintable.NewWriter(w)
+	qp.Write([]byte(text))
+	qp.Close()
+}
+
+// writeBase64 encodes data in lines of 76 characters as RFC 2045 requires.
+func writeBase64(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		io.WriteString(w, encoded[:76]+"\r\n")
+		encoded = encoded[76:]
 	}
+	io.WriteString(w, encoded+"\r\n")
+}
 
-	log.Printf("email notify: sending to %q", s.EmailAddress)
+type mailTransport interface {
+	send(from *mail.Address, to []*mail.Address, msg []byte) error
+}
+
+// programTransport pipes the message into a sendmail-compatible program,
+// passing it the recipients as arguments.
+type programTransport struct {
+	program string
+}
 
-	cmd := exec.Command(*flagEmailProgram, s.EmailAddress)
-	cmd.Stdin = &b
+func (t programTransport) send(from *mail.Address, to []*mail.Address, msg []byte) error {
+	var args []string
+	for _, addr := range to {
+		args = append(args, addr.Address)
+	}
+
+	cmd := exec.Command(t.program, args...)
+	cmd.Stdin = bytes.NewReader(msg)
 	cmd.Stdout = os.Stderr
 	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+type smtpTransport struct {
+	addr     string
+	security string
+	username string
+	password string
+}
 
-	err = cmd.Run()
+func (t smtpTransport) send(from *mail.Address, to []*mail.Address, msg []byte) error {
+	host, _, err := net.SplitHostPort(t.addr)
 	if err != nil {
-		log.Printf("email notify: %s", err)
+		return err
 	}
+	tlsConfig := &tls.Config{ServerName: host}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	var conn net.Conn
+	if t.security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", t.addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", t.addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Minute))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if t.security == "starttls" {
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if t.username != "" {
+		if err = c.Auth(smtp.PlainAuth("", t.username, t.password, host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err = c.Rcpt(addr.Address); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
 }
 
-func notifyInterrupted(s Script) {
-	t, err := template.New("").Funcs(emailFuncs).Parse(tmplInterrupted)
+// newTransport sets up the email transport the settings say, nil if there
+// is none.
+func newTransport(s *settings) (mailTransport, error) {
+	kind := s.emailTransport
+	if kind == "" {
+		if s.smtpServer != "" {
+			kind = "smtp"
+		} else {
+			kind = "program"
+		}
+	}
+
+	switch kind {
+	case "program":
+		if s.emailProgram != "" {
+			return programTransport{program: s.emailProgram}, nil
+		}
+		return nil, nil
+	case "smtp":
+		if s.smtpServer == "" {
+			return nil, errors.New("-smtp-server is required with the smtp email transport")
+		}
+		switch s.smtpTLS {
+		case "none", "starttls", "tls":
+		default:
+			return nil, fmt.Errorf("bad -smtp-tls value %q", s.smtpTLS)
+		}
+		t := smtpTransport{
+			addr:     s.smtpServer,
+			security: s.smtpTLS,
+			username: s.smtpUser,
+		}
+		if s.smtpPasswordFile != "" {
+			password, err := ioutil.ReadFile(s.smtpPasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read SMTP password: %v", err)
+			}
+			t.password = strings.TrimRight(string(password), "\r\n")
+		}
+		return t, nil
+	default:
+		return nil, fmt.Errorf("unknown email transport %q", kind)
+	}
+}
+
+// deliver sends the email, retrying with an increasing delay on failure.
+func deliver(m *email, retries int) error {
+	c := cfg()
+	transport := c.transport
+	if transport == nil {
+		return errors.New("no email transport configured")
+	}
+
+	from := emailFrom()
+	msg := m.compose(from)
+
+	return retry(retries, c.emailRetryDelay, func(attempt int, err error, delay time.Duration) {
+		slog.Warn("sending email failed, retrying", "to", formatAddressList(m.To),
+			"attempt", attempt, "retry_in", delay, "err", err)
+	}, func() error {
+		return transport.send(from, m.To, msg)
+	})
+}
+
+// emailTemplatePath finds the template for the event, looking for a
+// per-script override first, then a global one and finally falling back to
+// the template shipped with runtriggers.
+//
+// Notification templates start with a "Subject:" line followed by an empty
+// line and the body of the message. Other headers are filled in when the
+// message is composed.
+func emailTemplatePath(event string, scriptID int) string {
+	name := event + ".txt"
+	if dir := cfg().notifyTemplates; dir != "" {
+		candidates := []string{
+			filepath.Join(dir, "scripts", strconv.Itoa(scriptID), name),
+			filepath.Join(dir, name),
+		}
+		for _, p := range candidates {
+			if _, err := os.Stat(p); err == nil {
+				return p
+			}
+		}
+	}
+	return filepath.Join(templatesPath, "notify", name)
+}
+
+func renderEmail(n notification) (*email, error) {
+	p := emailTemplatePath(n.Event, n.Script.ID)
+	t, err := template.New(filepath.Base(p)).Funcs(emailFuncs).ParseFiles(p)
 	if err != nil {
-		log.Printf("email notify: failed to parse template: %s", err)
-		return
+		return nil, fmt.Errorf("failed to parse template: %s", err)
 	}
 	var b bytes.Buffer
-	err = t.Execute(&b, map[string]interface{}{
-		"script": s,
-	})
+	if err = t.Execute(&b, n); err != nil {
+		return nil, fmt.Errorf("failed to execute template %s: %s", p, err)
+	}
+
+	m, err := parseEmail(n.Script.EmailAddress, b.Bytes())
 	if err != nil {
-		log.Printf("email notify: failed to execute template: %s", err)
-		return
+		return nil, err
 	}
+	if n.Test {
+		m.Subject = "[test] " + m.Subject
+	}
+	if cfg().emailAttachLog && (n.Event == EventAnomalous || n.Event == EventInterrupted) {
+		m.attachLog(n.Script, n.Run)
+	}
+	return m, nil
+}
 
-	log.Printf("email notify: sending to %q", s.EmailAddress)
+func emailNotification(n notification) {
+	l := n.Script.logger().With("run_no", n.Run.RunNo, "event", n.Event)
+	m, err := renderEmail(n)
+	if err != nil {
+		l.Error("failed to render notification email", "err", err)
+		metricNotificationFailures.WithLabelValues("email").Inc()
+		return
+	}
 
-	cmd := exec.Command(*flagEmailProgram, s.EmailAddress)
-	cmd.Stdin = &b
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
+	l.Info("sending notification email", "to", n.Script.EmailAddress)
 
-	err = cmd.Run()
-	if err != nil {
-		log.Printf("email notify: %s", err)
+	if err = deliver(m, cfg().emailRetries); err != nil {
+		l.Error("giving up sending notification email", "to", n.Script.EmailAddress, "err", err)
+		metricNotificationFailures.WithLabelValues("email").Inc()
+		return
 	}
+	metricNotifications.WithLabelValues("email").Inc()
 }
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	flagGitopsRepo     = flag.String("gitops-repo", "", "path to a git repository to take script definitions from (GitOps mode)")
+	flagGitopsDir      = flag.String("gitops-dir", "", "directory within the git repository holding the script definitions")
+	flagGitopsInterval = flag.Duration("gitops-interval", time.Minute, "how often to pull the git repository")
+	flagGitopsOwner    = flag.String("gitops-owner", "", "owner of scripts from the git repository whose settings do not name one")
+)
+
+// A script in the repository is a directory with the script's text in
+// gitopsScriptFile and optionally its settings in gitopsSettingsFile, keyed
+// like in bundles, plus Owner. The directory name is the script's name.
+const (
+	gitopsScriptFile   = "run"
+	gitopsSettingsFile = "settings.yaml"
+	gitopsActor        = user("git")
+)
+
+type gitopsState struct {
+	sync.Mutex
+	commit string
+	synced time.Time
+	errors []string
+}
+
+var gitops gitopsState
+
+func initGitops() {
+	if *flagGitopsRepo == "" {
+		return
+	}
+	readinessChecks["gitops"] = checkGitops
+
+	gitopsSync()
+	go func() {
+		for range time.Tick(*flagGitopsInterval) {
+			gitopsSync()
+		}
+	}()
+}
+
+func checkGitops() (string, error) {
+	gitops.Lock()
+	defer gitops.Unlock()
+
+	if len(gitops.errors) > 0 {
+		return "", errors.New(strings.Join(gitops.errors, "; "))
+	}
+	return fmt.Sprintf("at commit %s, synchronized %s", gitops.commit, gitops.synced.Format(time.RFC3339)), nil
+}
+
+func git(args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", append([]string{"-C", *flagGitopsRepo}, args...)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitopsSync pulls the repository, if it has a remote to pull from, and
+// brings the scripts in line with the definitions in it.
+func gitopsSync() {
+	var errs []string
+
+	if remotes, err := git("remote"); err != nil {
+		errs = append(errs, err.Error())
+	} else if remotes != "" {
+		if _, err := git("pull", "--ff-only", "--quiet"); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	commit, err := git("rev-parse", "HEAD")
+	if err == nil {
+		errs = append(errs, gitopsReconcile(commit)...)
+	} else {
+		errs = append(errs, err.Error())
+	}
+
+	for _, e := range errs {
+		slog.Error("git synchronization", "err", e)
+	}
+
+	gitops.Lock()
+	gitops.commit = commit
+	gitops.synced = time.Now()
+	gitops.errors = errs
+	gitops.Unlock()
+}
+
+func readGitopsScript(dir string) (bundleScript, error) {
+	bs := bundleScript{Name: filepath.Base(dir)}
+
+	text, err := ioutil.ReadFile(filepath.Join(dir, gitopsScriptFile))
+	if err != nil {
+		return bs, err
+	}
+	bs.Text = string(text)
+
+	settings, err := ioutil.ReadFile(filepath.Join(dir, gitopsSettingsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return bs, err
+	}
+	if err := yaml.Unmarshal(settings, &bs.Settings); err != nil {
+		return bs, fmt.Errorf("%s: %v", gitopsSettingsFile, err)
+	}
+
+	bs.Owner = user(*flagGitopsOwner)
+	if owner, ok := bs.Settings["Owner"]; ok {
+		name, ok := owner.(string)
+		if !ok {
+			return bs, errors.New("Owner must be a user name")
+		}
+		bs.Owner = user(name)
+		delete(bs.Settings, "Owner")
+	}
+	if bs.Owner == "" {
+		return bs, errors.New("no owner, set Owner in " + gitopsSettingsFile + " or use -gitops-owner")
+	}
+	return bs, nil
+}
+
+// gitopsReconcile creates and updates the scripts defined in git so that
+// they match the repository. Scripts are changed only if their definition
+// did, so that they are not restarted on every commit. Scripts whose
+// definition is gone are orphaned rather than deleted, keeping their runs,
+// and nothing is done at all if the repository defines no scripts, as it
+// looks to with a wrong -gitops-dir.
+func gitopsReconcile(commit string) []string {
+	var errs []string
+
+	root := filepath.Join(*flagGitopsRepo, *flagGitopsDir)
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	managed := make(map[string]*Script)
+	for _, s := range allScripts.get() {
+		if s.GitPath != "" {
+			managed[s.GitPath] = s
+		}
+	}
+
+	defined := make(map[string]bool)
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		dir := filepath.Join(root, e.Name())
+		if _, err := os.Stat(filepath.Join(dir, gitopsScriptFile)); err != nil {
+			continue
+		}
+		path := filepath.ToSlash(filepath.Join(*flagGitopsDir, e.Name()))
+		defined[path] = true
+	}
+	if len(defined) == 0 && len(managed) > 0 {
+		return []string{fmt.Sprintf("no scripts in %s, leaving the %d scripts from git alone", root, len(managed))}
+	}
+
+	for _, e := range entries {
+		path := filepath.ToSlash(filepath.Join(*flagGitopsDir, e.Name()))
+		if !defined[path] {
+			continue
+		}
+		dir := filepath.Join(root, e.Name())
+
+		bs, err := readGitopsScript(dir)
+		if err != nil {
+			errs = append(errs, path+": "+err.Error())
+			continue
+		}
+		bs.Settings = newScriptSettings(bs.Settings)
+		form, err := bs.form()
+		if err != nil {
+			errs = append(errs, path+": "+err.Error())
+			continue
+		}
+
+		s := Script{GitPath: path}
+		old, exists := managed[path]
+		if exists {
+			s = old.Copy()
+		}
+		s.Owner = bs.Owner
+		s.Text = bs.Text
+		if issues := applyParams(&s, form); len(issues) > 0 {
+			var msgs []string
+			for field, issue := range issues {
+				msgs = append(msgs, field+": "+issue)
+			}
+			sort.Strings(msgs)
+			errs = append(errs, path+": "+strings.Join(msgs, "; "))
+			continue
+		}
+
+		if exists && !old.GitOrphaned && reflect.DeepEqual(newBundle([]*Script{old}, true), newBundle([]*Script{&s}, true)) {
+			continue
+		}
+		s.GitCommit = commit
+		s.GitOrphaned = false
+		if err := allScripts.save(&s); err != nil {
+			errs = append(errs, path+": "+err.Error())
+			continue
+		}
+
+		action := ActionCreate
+		if exists {
+			action = ActionUpdate
+		}
+		auditAs(gitopsActor, "git", action, s.ID, url.Values{"Name": {s.Name}, "commit": {commit}})
+		s.logger().Info("script synchronized from git", "path", path, "commit", commit)
+	}
+
+	for path, old := range managed {
+		if defined[path] || old.GitOrphaned {
+			continue
+		}
+		s := old.Copy()
+		s.PeriodicRunsEnabled = false
+		s.ScheduledRunsEnabled = false
+		s.Scheduled = nil
+		s.GitOrphaned = true
+		if err := allScripts.save(&s); err != nil {
+			errs = append(errs, path+": "+err.Error())
+			continue
+		}
+		auditAs(gitopsActor, "git", ActionUpdate, s.ID, url.Values{"Name": {s.Name}, "commit": {commit}, "orphaned": {"true"}})
+		s.logger().Warn("script removed from git, stopped its automatic runs", "path", path, "commit", commit)
+	}
+
+	return errs
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+)
+
+type checkResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	Note  string `json:"note,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// readinessChecks are run by /readyz. A check returns an error if runtriggers
+// cannot do its job, or a note to pass on otherwise.
+var readinessChecks = map[string]func() (string, error){
+	"database":  checkDatabase,
+	"log_dir":   checkLogDir,
+	"templates": checkTemplates,
+	"su_exec":   checkSuExec,
+	"email":     checkEmail,
+}
+
+func checkDatabase() (string, error) {
+	if err := db.DB().Ping(); err != nil {
+		return "", err
+	}
+	var n int
+	return "", db.Model(&Script{}).Count(&n).Error
+}
+
+func checkLogDir() (string, error) {
+	if err := os.MkdirAll(*flagLogDir, 0755); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(*flagLogDir, ".readyz")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return "", os.Remove(f.Name())
+}
+
+func checkTemplates() (string, error) {
+	if templates.Load() == nil {
+		return "", errors.New("templates not loaded")
+	}
+	return "", nil
+}
+
+func checkSuExec() (string, error) {
+	return exec.LookPath("su-exec")
+}
+
+func checkEmail() (string, error) {
+	if cfg().transport != nil {
+		return "", nil
+	}
+	var n int
+	if err := db.Model(&Script{}).Where("email_address <> ''").Count(&n).Error; err != nil {
+		return "", err
+	}
+	if n > 0 {
+		return "", errors.New("no email transport configured, but scripts have email addresses set")
+	}
+	return "no email transport configured", nil
+}
+
+func writeHealth(w http.ResponseWriter, code int, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
+
+// healthz tells the process is alive and serving requests.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthReport{Status: "ok"})
+}
+
+// readyz tells if everything runtriggers depends on is in place.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{Status: "ok", Checks: make(map[string]checkResult)}
+	code := http.StatusOK
+
+	for name, check := range readinessChecks {
+		note, err := check()
+		if err != nil {
+			report.Checks[name] = checkResult{Error: err.Error()}
+			report.Status = "fail"
+			code = http.StatusServiceUnavailable
+			continue
+		}
+		report.Checks[name] = checkResult{OK: true, Note: note}
+	}
+
+	writeHealth(w, code, report)
+}
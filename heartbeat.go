@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of scripts. Heartbeat scripts have no code to run, they watch that
+// a job outside of runtriggers keeps requesting their ping URL.
+const (
+	KindScript    = "script"
+	KindHeartbeat = "heartbeat"
+)
+
+var scriptKinds = []string{KindScript, KindHeartbeat}
+
+// maxPingBody is how much of a ping request's body is kept in the log.
+const maxPingBody = 10 * 1024
+
+type ping struct {
+	source string
+	body   []byte
+}
+
+// PingURL is the URL a heartbeat script expects to be requested.
+func (s Script) PingURL() string {
+	p := "/ping/" + s.PingToken
+	if *flagBacklink == "" {
+		return Link(p)
+	}
+	return backLink(p)
+}
+
+// heartbeatDeadline returns the time by which the next ping is due. There is
+// no deadline before the first ping.
+func (s *Script) heartbeatDeadline() (time.Time, bool) {
+	if s.RunCounter == 0 {
+		return time.Time{}, false
+	}
+
+	period, err := time.ParseDuration(s.HeartbeatPeriod)
+	if err != nil {
+		s.logger().Error("failed to parse heartbeat period", "period", s.HeartbeatPeriod, "err", err)
+		return time.Time{}, false
+	}
+	grace, _ := time.ParseDuration(s.HeartbeatGrace)
+
+	var lastRun Run
+	if err = db.Where("script_id=? AND run_no=?", s.ID, s.RunCounter).First(&lastRun).Error; err != nil {
+		s.logger().Error("failed to find last run", "run_no", s.RunCounter, "err", err)
+		return time.Time{}, false
+	}
+	return lastRun.StartTime.Add(period + grace), true
+}
+
+// ping hands a ping over to the script's loop. Pings arriving while one is
+// already waiting to be recorded are dropped.
+func (s *Script) ping(p ping) {
+	select {
+	case s.pingch <- p:
+	default:
+	}
+}
+
+// heartbeat records a run for a received ping, or an anomalous one for a
+// ping which did not arrive in time.
+func (s *Script) heartbeat(cause Cause, p ping) {
+	if cause == CausePing {
+		s.record(Run{Cause: cause, State: StateDone},
+			fmt.Sprintf("runtriggers: ping from %s\n", p.source)+string(p.body))
+		return
+	}
+
+	message := fmt.Sprintf("runtriggers: no ping within %s", s.HeartbeatPeriod)
+	if s.HeartbeatGrace != "" {
+		message += fmt.Sprintf(" plus grace period of %s", s.HeartbeatGrace)
+	}
+	s.record(Run{Cause: cause, State: StateMissed}, message+"\n")
+}
+
+func pingScript(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	var script Script
+	if err := db.Where("kind = ? AND ping_token = ?", KindHeartbeat, token).First(&script).Error; err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	s, ok := allScripts.lookup(script.ID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(r.Body, maxPingBody))
+	s.ping(ping{source: requestSource(r), body: body})
+	fmt.Fprintln(w, "OK")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPingScript(t *testing.T) {
+	testDB(t)
+
+	heartbeat := &Script{Name: "nightly", Kind: KindHeartbeat, PingToken: "good-token", pingch: make(chan ping, 1)}
+	// scripts not watching heartbeats do not take pings, whatever their token
+	other := &Script{Name: "other", Kind: KindScript, PingToken: "script-token", pingch: make(chan ping, 1)}
+	for _, s := range []*Script{heartbeat, other} {
+		if err := db.Create(s).Error; err != nil {
+			t.Fatal(err)
+		}
+		allScripts.scripts[s.ID] = s
+	}
+	t.Cleanup(func() {
+		delete(allScripts.scripts, heartbeat.ID)
+		delete(allScripts.scripts, other.ID)
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/ping/{token}", pingScript)
+	for _, tc := range []struct {
+		token  string
+		status int
+	}{
+		{"good-token", 200},
+		{"script-token", 404},
+		{"unknown", 404},
+		{"good", 404},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/ping/"+tc.token, strings.NewReader("done")))
+		if w.Code != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.token, w.Code, tc.status)
+		}
+	}
+
+	select {
+	case p := <-heartbeat.pingch:
+		if string(p.body) != "done" || p.source == "" {
+			t.Errorf("ping %+v", p)
+		}
+	default:
+		t.Error("heartbeat not pinged")
+	}
+	if len(other.pingch) != 0 {
+		t.Error("script of another kind pinged")
+	}
+}
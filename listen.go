@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	osUser "os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	flagTLSCert = flag.String("tls-cert", "", "path to a PEM file with the certificate (chain) to serve HTTPS with; reloaded when it changes")
+	flagTLSKey  = flag.String("tls-key", "", "path to a PEM file with the private key of -tls-cert")
+)
+
+// certCheckInterval is how often handshakes look whether the certificate
+// files changed.
+const certCheckInterval = 10 * time.Second
+
+// certificate holds the TLS certificate, and reloads it from its files
+// when they change, as they do on renewals.
+type certificate struct {
+	certFile, keyFile string
+
+	sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+var serverCert *certificate
+
+func initTLS() {
+	if (*flagTLSCert == "") != (*flagTLSKey == "") {
+		fatal("-tls-cert and -tls-key have to be given together")
+	}
+	if *flagTLSCert == "" {
+		return
+	}
+	serverCert = &certificate{certFile: *flagTLSCert, keyFile: *flagTLSKey}
+	if err := serverCert.reload(); err != nil {
+		fatal("failed to load the TLS certificate", "err", err)
+	}
+}
+
+// usesTLS tells if connections to the listener are served over TLS, which
+// only TCP listeners are. Local clients like rtctl speak plain HTTP over
+// unix sockets.
+func usesTLS(l net.Listener) bool {
+	return serverCert != nil && l.Addr().Network() == "tcp"
+}
+
+// filesModTime returns the latest modification time of the files.
+func (c *certificate) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload loads the certificate from its files. On error, the one loaded
+// before stays in use.
+func (c *certificate) reload() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.cert, c.modTime, c.checked = &cert, modTime, time.Now()
+	c.Unlock()
+	return nil
+}
+
+// reloadIfChanged reloads the certificate if its files changed since it
+// was loaded.
+func (c *certificate) reloadIfChanged() {
+	c.Lock()
+	loaded := c.modTime
+	c.Unlock()
+	modTime, err := c.filesModTime()
+	if err != nil || modTime.Equal(loaded) {
+		return
+	}
+	if err := c.reload(); err != nil {
+		slog.Error("failed to reload the TLS certificate, keeping the old one", "cert", c.certFile, "err", err)
+		return
+	}
+	slog.Info("reloaded the TLS certificate", "cert", c.certFile)
+}
+
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.Lock()
+	check := time.Since(c.checked) > certCheckInterval
+	if check {
+		c.checked = time.Now()
+	}
+	c.Unlock()
+	if check {
+		c.reloadIfChanged()
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	return c.cert, nil
+}
+
+func tlsConfig() *tls.Config {
+	if serverCert == nil {
+		return nil
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: serverCert.get,
+	}
+}
+
+var serverListeners []net.Listener
+
+// initListeners takes the sockets systemd passed on socket activation, or
+// else listens where -listen says. It comes before scripts start, so that
+// they inherit neither.
+func initListeners() {
+	ls, err := systemdListeners()
+	if err != nil {
+		fatal("failed to use the sockets passed by systemd", "err", err)
+	}
+	if len(ls) > 0 {
+		for _, l := range ls {
+			slog.Info("listening on socket from systemd", "addr", l.Addr().String(), "tls", usesTLS(l))
+		}
+		serverListeners = ls
+	} else {
+		l := listen(*flagListenAddr)
+		slog.Info("listening", "addr", *flagListenAddr, "tls", usesTLS(l))
+		serverListeners = []net.Listener{l}
+	}
+
+	for _, l := range serverListeners {
+		if usesTLS(l) {
+			// browsers reach runtriggers over HTTPS then
+			*flagSecureCookies = true
+		}
+	}
+}
+
+func listen(addr string) net.Listener {
+	var l net.Listener
+	var err error
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		if _, err = os.Stat(path); err == nil {
+			syscall.Unlink(path)
+		}
+		l, err = net.Listen("unix", strings.TrimPrefix(addr, "unix:"))
+		if err != nil {
+			fatal("failed to listen", "addr", addr, "err", err)
+		}
+		if err = os.Chmod(path, 0775); err != nil {
+			slog.Warn("failed changing socket file permissions mode", "path", path, "err", err)
+		}
+		if grp, err := osUser.LookupGroup("runtriggers"); err == nil {
+			gid, _ := strconv.Atoi(grp.Gid)
+			if err = os.Chown(path, os.Getuid(), gid); err != nil {
+				slog.Warn("failed changing socket file group ownership", "path", path, "err", err)
+			}
+		}
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		fatal("failed to listen", "addr", addr, "err", err)
+	}
+	return l
+}
+
+// systemdListeners takes over the sockets systemd passes with socket
+// activation, starting at file descriptor 3, as described in
+// sd_listen_fds(3). It unsets the variables saying so, lest scripts take
+// them for themselves.
+func systemdListeners() ([]net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid == "" || fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("bad LISTEN_FDS %q", fds)
+	}
+
+	var ls []net.Listener
+	for fd := 3; fd < 3+n; fd++ {
+		f := os.NewFile(uintptr(fd), "systemd-socket-"+strconv.Itoa(fd))
+		// takes a copy of the descriptor, which unlike the passed one is
+		// not inherited by scripts
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("file descriptor %d: %v", fd, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+)
+
+var (
+	flagLogFormat = flag.String("log-format", "logfmt", "format of the server's own log: logfmt or json")
+	flagLogLevel  = flag.String("log-level", "info", "minimum level of messages in the server's log: debug, info, warn or error")
+)
+
+// logLevel can change when the configuration is reloaded.
+var logLevel slog.LevelVar
+
+func initLogging() {
+	if err := logLevel.UnmarshalText([]byte(*flagLogLevel)); err != nil {
+		fmt.Fprintf(os.Stderr, "bad -log-level %q\n", *flagLogLevel)
+		os.Exit(2)
+	}
+	opts := &slog.HandlerOptions{Level: &logLevel}
+
+	var h slog.Handler
+	switch *flagLogFormat {
+	case "logfmt":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		fmt.Fprintf(os.Stderr, "bad -log-format %q\n", *flagLogFormat)
+		os.Exit(2)
+	}
+	// also takes over the standard logger, used by some of the libraries
+	slog.SetDefault(slog.New(h))
+}
+
+// fatal logs the error and exits.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logger returns a logger carrying the script's identity.
+func (s *Script) logger() *slog.Logger {
+	return slog.With("script_id", s.ID, "script", s.Name)
+}
+
+type loggerKey struct{}
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID is a middleware giving every request an ID, taken over from
+// a proxy's X-Request-ID header if there is one. The ID is sent back in the
+// response and included in everything logged about the request.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = randomString()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		l := slog.With("request_id", id, "remote", requestSource(r))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loggerKey{}, l)))
+	})
+}
+
+// reqLog returns the logger for the request.
+func reqLog(r *http.Request) *slog.Logger {
+	if l, ok := r.Context().Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// withUser adds the authenticated user to the request's logger.
+func withUser(r *http.Request, u user) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), loggerKey{}, reqLog(r).With("user", u)))
+}
+
+// gormLogger passes the database library's messages on to the log, queries
+// at the debug level.
+type gormLogger struct{}
+
+func (gormLogger) Print(v ...interface{}) {
+	if len(v) < 2 {
+		return
+	}
+	if v[0] == "sql" && len(v) >= 6 {
+		slog.Debug("sql query", "source", v[1], "duration", v[2], "query", v[3], "vars", v[4], "rows", v[5])
+		return
+	}
+	slog.Warn("database", "source", v[1], "details", fmt.Sprint(v[2:]...))
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
-	"log"
+	"bytes"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -14,6 +15,7 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	CheckOrigin:     sameOrigin,
 }
 
 type stateMessage struct {
@@ -41,6 +43,44 @@ func fetchScriptState(s *Script) (stateMessage, error) {
 	return ret, nil
 }
 
+// logTail returns up to n last lines of a log file.
+func logTail(filename string, n int) []string {
+	const maxRead = 64 * 1024
+
+	if n <= 0 || filename == "" {
+		return nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var offset int64
+	if fi, err := f.Stat(); err == nil && fi.Size() > maxRead {
+		offset = fi.Size() - maxRead
+	}
+	buf := make([]byte, maxRead)
+	nread, _ := f.ReadAt(buf, offset)
+	buf = buf[:nread]
+	if offset > 0 {
+		// drop the partial first line
+		if idx := bytes.IndexByte(buf, '\n'); idx >= 0 {
+			buf = buf[idx+1:]
+		}
+	}
+
+	lines := strings.Split(strings.TrimRight(string(buf), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+	return lines
+}
+
 func logWstail(w http.ResponseWriter, r *http.Request, u user) {
 	vars := mux.Vars(r)
 	id, _ := strconv.Atoi(vars["id"])
@@ -53,7 +93,7 @@ func logWstail(w http.ResponseWriter, r *http.Request, u user) {
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("log tail: %s: failed to upgrade: %s\n", r.RemoteAddr, err)
+		reqLog(r).Warn("failed to upgrade log tail to websocket", "err", err)
 		return
 	}
 
@@ -150,6 +190,6 @@ err2:
 	conn.Close()
 
 	if err != nil {
-		log.Printf("request from %s, script %d: log tailing: %s", r.RemoteAddr, id, err)
+		reqLog(r).Warn("log tailing failed", "script_id", id, "err", err)
 	}
 }
@@ -7,12 +7,13 @@ import (
 	"fmt"
 	"html/template"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
 	"os/exec"
-	osUser "os/user"
 	"path"
 	"path/filepath"
 	"reflect"
@@ -22,7 +23,9 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
@@ -32,7 +35,8 @@ var (
 var (
 	flagDebug      = flag.Bool("debug", false, "run in debug mode")
 	flagListenAddr = flag.String("listen", "127.0.0.1:80", "address for HTTP server to listen on")
-	flagDatabase   = flag.String("db", "test.db", "path to sqlite database")
+	flagDatabase   = flag.String("db", "test.db", "path to sqlite database, or connection string for postgres (e.g. \"host=db user=runtriggers dbname=runtriggers sslmode=disable\")")
+	flagDBDriver   = flag.String("db-driver", "sqlite3", "database driver: sqlite3 or postgres")
 	flagLogDir     = flag.String("log", "/tmp/runtriggers_logs", "path to directory to store logs in")
 
 	flagBasePath = flag.String("basepath", "", "path prefix of runtriggers web tree")
@@ -63,7 +67,7 @@ func initPaths() {
 	if dataDir == "" {
 		execPath, err := os.Executable()
 		if err != nil {
-			log.Panicf("os.Executable(): %s", err)
+			fatal("failed to find the executable", "err", err)
 		}
 		dataDir = path.Dir(execPath)
 	}
@@ -95,13 +99,13 @@ func readTemplates() (*template.Template, error) {
 		"FormatDuration": FormatDuration,
 	}
 
-	return template.New("").Funcs(funcMap).ParseGlob(templatesPath + "/*")
+	return template.New("").Funcs(funcMap).ParseGlob(templatesPath + "/*.html")
 }
 
 func loadTemplates() {
 	new, err := readTemplates()
 	if err != nil {
-		log.Printf("error reading templates: %s", err)
+		slog.Error("failed to read templates", "err", err)
 		return
 	}
 	templates.Store(new)
@@ -110,7 +114,7 @@ func loadTemplates() {
 func initTemplates() {
 	loadTemplates()
 	if templates.Load() == nil {
-		log.Fatalf("failed to read templates")
+		fatal("failed to read templates", "path", templatesPath)
 	}
 }
 
@@ -122,7 +126,10 @@ func tmpl() *template.Template {
 	return templates.Load().(*template.Template)
 }
 
-func execTmpl(w http.ResponseWriter, name string, data interface{}) {
+func execTmpl(w http.ResponseWriter, r *http.Request, name string, data map[string]interface{}) {
+	data["csrfField"] = csrf.TemplateField(r)
+	data["sessions"] = usesSessions()
+
 	funcMap := template.FuncMap{
 		"sh":             Sh,
 		"link":           Link,
@@ -139,7 +146,8 @@ func execTmpl(w http.ResponseWriter, name string, data interface{}) {
 		} else {
 			http.Error(w, "internal server error", 500)
 		}
-		log.Printf("executing template %s: %s\n", name, err)
+		reqLog(r).Error("failed to parse template", "template", name, "err", err)
+		return
 	}
 	templ.ExecuteTemplate(w, name+".html", data)
 	/*
@@ -150,7 +158,7 @@ func execTmpl(w http.ResponseWriter, name string, data interface{}) {
 			} else {
 				http.Error(w, "internal server error", 500)
 			}
-			log.Printf("executing template %s: %s\n", name, err)
+			reqLog(r).Error("failed to execute template", "template", name, "err", err)
 		}
 	*/
 }
@@ -161,6 +169,15 @@ func fillScripts(runs []Run) {
 	}
 }
 
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 func setFlashAndRedirect(w http.ResponseWriter, r *http.Request, url string, typ, msg string) {
 	setFlashMessages(w, []flashMessage{{ID: typ, Args: []string{msg}}})
 	http.Redirect(w, r, url, http.StatusFound)
@@ -173,41 +190,52 @@ func listJobs(w http.ResponseWriter, r *http.Request, u user) {
 	db.Order("start_time desc").Limit(25).Find(&runs)
 	fillScripts(runs)
 
-	execTmpl(w, "list", map[string]interface{}{
+	spark, err := sparklines()
+	if err != nil {
+		reqLog(r).Error("failed to compute sparklines", "err", err)
+	}
+
+	execTmpl(w, r, "list", map[string]interface{}{
 		"user":          u,
 		"flashMessages": flashMessages,
 		"scripts":       allScripts.get(),
 		"runs":          runs,
+		"sparklines":    spark,
 	})
 }
 
 func getRequestUser(r *http.Request) user {
 	if *flagMockUser != "" {
 		return user(*flagMockUser)
-	} else {
-		return user(r.Header.Get("X-Forwarded-User"))
 	}
+
+	u, err := auth.authenticate(r)
+	if err != nil {
+		reqLog(r).Warn("authentication failed", "err", err)
+		return ""
+	}
+	return u
 }
 
 func requireLogin(handler func(http.ResponseWriter, *http.Request, user)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := getRequestUser(r)
 
-		if user == "" {
+		if user == "" && usesSessions() {
+			loginRedirect(w, r)
+		} else if user == "" {
 			http.Error(w, "forbidden", 403)
 		} else {
-			handler(w, r, user)
+			handler(w, withUser(r, user), user)
 		}
 	}
 }
 
-func updateScriptFromForm(w http.ResponseWriter, r *http.Request, s *Script, u user) {
-	flashMessages := getFlashMessages(w, r)
+// applyParams sets the param-tagged fields of the script from the form and
+// checks them, returning the issues found by field name.
+func applyParams(s *Script, form url.Values) map[string]string {
 	issues := make(map[string]string)
 
-	r.ParseForm()
-	s.Text = strings.ReplaceAll(r.Form.Get("Text"), "\r\n", "\n")
-
 	v := reflect.ValueOf(s).Elem()
 	t := reflect.TypeOf(*s)
 	for i := 0; i < t.NumField(); i++ {
@@ -215,13 +243,18 @@ func updateScriptFromForm(w http.ResponseWriter, r *http.Request, s *Script, u u
 		tag := t.Field(i).Tag.Get("param")
 		switch tag {
 		case "bool":
-			v.Field(i).SetBool(r.Form.Get(name) == "on")
+			v.Field(i).SetBool(form.Get(name) == "on")
 		case "string":
-			v.Field(i).SetString(r.Form.Get(name))
+			v.Field(i).SetString(form.Get(name))
+		case "int":
+			n, err := strconv.Atoi(form.Get(name))
+			if err != nil && form.Get(name) != "" {
+				issues[name] = "Not a number"
+			}
+			v.Field(i).SetInt(int64(n))
 		case "":
 		default:
-			log.Printf("field '%s' of Script has an unhandled param tag with value %s!",
-				name, tag)
+			slog.Error("field of Script has an unhandled param tag", "field", name, "tag", tag)
 		}
 	}
 
@@ -229,10 +262,75 @@ func updateScriptFromForm(w http.ResponseWriter, r *http.Request, s *Script, u u
 		issues["Name"] = "Name cannot be empty"
 	}
 
+	if s.Kind == "" {
+		s.Kind = KindScript
+	}
+	if !containsString(scriptKinds, s.Kind) {
+		issues["Kind"] = "Unknown script kind"
+	}
+
+	if s.Kind == KindHeartbeat {
+		if _, err := time.ParseDuration(s.HeartbeatPeriod); err != nil {
+			issues["HeartbeatPeriod"] = "Period invalid: " + err.Error()
+		}
+		if _, err := time.ParseDuration(s.HeartbeatGrace); s.HeartbeatGrace != "" && err != nil {
+			issues["HeartbeatGrace"] = "Period invalid: " + err.Error()
+		}
+		if s.PingToken == "" {
+			s.PingToken = randomString()
+		}
+	}
+
 	if _, err := time.ParseDuration(s.RunPeriod); s.PeriodicRunsEnabled && err != nil {
 		issues["RunPeriod"] = "Period invalid: " + err.Error()
 	}
 
+	if s.MisfirePolicy == "" {
+		s.MisfirePolicy = MisfireRunOnce
+	}
+	if !containsString(misfirePolicies, s.MisfirePolicy) {
+		issues["MisfirePolicy"] = "Unknown misfire policy"
+	}
+
+	if _, err := time.ParseDuration(s.MisfireThreshold); s.MisfireThreshold != "" && err != nil {
+		issues["MisfireThreshold"] = "Period invalid: " + err.Error()
+	}
+
+	if _, err := time.ParseDuration(s.NotifyQuietPeriod); s.NotifyQuietPeriod != "" && err != nil {
+		issues["NotifyQuietPeriod"] = "Period invalid: " + err.Error()
+	}
+
+	if _, err := mail.ParseAddressList(s.EmailAddress); s.EmailAddress != "" && err != nil {
+		issues["EmailAddress"] = "Invalid address list: " + err.Error()
+	}
+
+	if s.WebhookURL != "" {
+		if u, err := url.Parse(s.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			issues["WebhookURL"] = "Webhook URL must be an absolute http or https URL"
+		}
+	}
+
+	if s.WebhookFormat == "" {
+		s.WebhookFormat = webhookFormats[0]
+	}
+	if !containsString(webhookFormats, s.WebhookFormat) {
+		issues["WebhookFormat"] = "Unknown webhook format"
+	}
+
+	return issues
+}
+
+func updateScriptFromForm(w http.ResponseWriter, r *http.Request, s *Script, u user) {
+	flashMessages := getFlashMessages(w, r)
+
+	r.ParseForm()
+	s.Text = strings.ReplaceAll(r.Form.Get("Text"), "\r\n", "\n")
+	// the secret is never shown, so an empty field keeps it
+	if r.Form.Get("WebhookSecret") == "" && r.Form.Get("ClearWebhookSecret") != "on" {
+		r.Form.Set("WebhookSecret", s.WebhookSecret)
+	}
+	issues := applyParams(s, r.Form)
+
 	if len(issues) == 0 {
 		new := s.ID == 0
 
@@ -244,10 +342,14 @@ func updateScriptFromForm(w http.ResponseWriter, r *http.Request, s *Script, u u
 		} else {
 			var msg string
 			if new {
+				audit(r, u, ActionCreate, s.ID, 0, r.Form)
 				msg = "Script created"
 			} else {
+				audit(r, u, ActionUpdate, s.ID, 0, r.Form)
 				if r.Form.Get("save_and_run") == "1" {
-					s.manual()
+					if started, err := s.manual(u, nil); err == nil {
+						audit(r, u, ActionRun, s.ID, startedRunNo(started), nil)
+					}
 					msg = "Script updated & manually triggered to run"
 				} else {
 					msg = "Script updated"
@@ -257,25 +359,31 @@ func updateScriptFromForm(w http.ResponseWriter, r *http.Request, s *Script, u u
 		}
 	}
 
-	execTmpl(w, "script", map[string]interface{}{
-		"user":          u,
-		"flashMessages": flashMessages,
-		"Script":        s,
-		"issues":        issues,
+	execTmpl(w, r, "script", map[string]interface{}{
+		"user":            u,
+		"flashMessages":   flashMessages,
+		"Script":          s,
+		"issues":          issues,
+		"webhookFormats":  webhookFormats,
+		"scriptKinds":     scriptKinds,
+		"misfirePolicies": misfirePolicies,
 	})
 }
 
 func newScript(w http.ResponseWriter, r *http.Request, u user) {
-	s := Script{Owner: u}
+	s := defaultScript(u)
 
 	if r.Method == "POST" {
 		updateScriptFromForm(w, r, &s, u)
 	} else {
-		execTmpl(w, "script", map[string]interface{}{
-			"user":          u,
-			"flashMessages": getFlashMessages(w, r),
-			"Script":        s,
-			"issues":        map[string]string{},
+		execTmpl(w, r, "script", map[string]interface{}{
+			"user":            u,
+			"flashMessages":   getFlashMessages(w, r),
+			"Script":          s,
+			"issues":          map[string]string{},
+			"webhookFormats":  webhookFormats,
+			"scriptKinds":     scriptKinds,
+			"misfirePolicies": misfirePolicies,
 		})
 	}
 }
@@ -300,20 +408,38 @@ func showScript(w http.ResponseWriter, r *http.Request, u user) {
 	}
 
 	if r.Method == "POST" {
+		if s.GitPath != "" {
+			setFlashAndRedirect(w, r, Link(fmt.Sprintf("/scripts/%d", s.ID)), "error", "The script is defined in git and cannot be changed here")
+			return
+		}
 		newScript := s.Copy()
 		updateScriptFromForm(w, r, &newScript, u)
 	} else {
-		execTmpl(w, "script", map[string]interface{}{
-			"user":          u,
-			"flashMessages": getFlashMessages(w, r),
-			"Script":        s,
-			"issues":        map[string]string{},
-			"runs":          runs,
-			"running":       running,
+		execTmpl(w, r, "script", map[string]interface{}{
+			"user":            u,
+			"flashMessages":   getFlashMessages(w, r),
+			"Script":          s,
+			"issues":          map[string]string{},
+			"webhookFormats":  webhookFormats,
+			"scriptKinds":     scriptKinds,
+			"misfirePolicies": misfirePolicies,
+			"runs":            runs,
+			"running":         running,
 		})
 	}
 }
 
+// startedRunNo waits for a triggered run to start and returns its number,
+// or 0 if it failed to start or is queued behind a running one.
+func startedRunNo(started <-chan int) int {
+	select {
+	case runNo := <-started:
+		return runNo
+	case <-time.After(runStartWait):
+		return 0
+	}
+}
+
 func runScript(w http.ResponseWriter, r *http.Request, u user) {
 	vars := mux.Vars(r)
 	id, _ := strconv.Atoi(vars["id"])
@@ -324,7 +450,12 @@ func runScript(w http.ResponseWriter, r *http.Request, u user) {
 		return
 	}
 
-	s.manual()
+	started, err := s.manual(u, nil)
+	if err != nil {
+		setFlashAndRedirect(w, r, Link(fmt.Sprintf("/scripts/%d", s.ID)), "error", fmt.Sprintf("Could not trigger a run: %s", err))
+		return
+	}
+	audit(r, u, ActionRun, s.ID, startedRunNo(started), nil)
 
 	setFlashAndRedirect(w, r, Link(fmt.Sprintf("/scripts/%d", s.ID)), "info", "Triggered a manual run")
 }
@@ -339,14 +470,39 @@ func deleteScript(w http.ResponseWriter, r *http.Request, u user) {
 		return
 	}
 
+	if s.GitPath != "" && !s.GitOrphaned {
+		setFlashAndRedirect(w, r, Link(fmt.Sprintf("/scripts/%d", s.ID)), "error", "The script is defined in git and cannot be deleted here")
+		return
+	}
+
 	err := allScripts.delete(id)
 	if err != nil {
 		setFlashAndRedirect(w, r, Link(fmt.Sprintf("/scripts/%d", s.ID)), "error", fmt.Sprintf("Failed to delete script: %s", err))
 	} else {
+		audit(r, u, ActionDelete, s.ID, 0, url.Values{"Name": {s.Name}})
 		setFlashAndRedirect(w, r, Link("/"), "success", fmt.Sprintf("Script '%s' deleted", s.Name))
 	}
 }
 
+func notifyTestScript(w http.ResponseWriter, r *http.Request, u user) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	s, ok := allScripts.lookup(id)
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	audit(r, u, ActionNotifyTest, s.ID, 0, nil)
+	if err := testNotification(s.Copy()); err != nil {
+		setFlashAndRedirect(w, r, Link(fmt.Sprintf("/scripts/%d", s.ID)), "error", fmt.Sprintf("Test notification failed: %s", err))
+		return
+	}
+
+	setFlashAndRedirect(w, r, Link(fmt.Sprintf("/scripts/%d", s.ID)), "success", "Test notification sent")
+}
+
 func scheduleScriptX(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, _ := strconv.Atoi(vars["id"])
@@ -372,6 +528,7 @@ func scheduleScriptX(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.schedule(time)
+	audit(r, getRequestUser(r), ActionSchedule, s.ID, 0, url.Values{"Time": {string(body)}})
 }
 
 func scheduleScript(w http.ResponseWriter, r *http.Request, u user) {
@@ -393,6 +550,7 @@ func scheduleScript(w http.ResponseWriter, r *http.Request, u user) {
 	}
 
 	s.schedule(time)
+	audit(r, u, ActionSchedule, s.ID, 0, r.Form)
 	setFlashAndRedirect(w, r, Link(fmt.Sprintf("/scripts/%d", s.ID)), "success", "Script scheduled")
 }
 
@@ -407,6 +565,7 @@ func unscheduleScript(w http.ResponseWriter, r *http.Request, u user) {
 	}
 
 	s.unschedule()
+	audit(r, u, ActionUnschedule, s.ID, 0, nil)
 	setFlashAndRedirect(w, r, Link(fmt.Sprintf("/scripts/%d", s.ID)), "success", "Script scheduling cleared")
 }
 
@@ -421,19 +580,10 @@ func killScript(w http.ResponseWriter, r *http.Request, u user) {
 		return
 	}
 
-	var err error
-
-	sig := syscall.Signal(signo)
-	switch sig {
-	case syscall.SIGKILL:
-	case syscall.SIGTERM:
-	case syscall.SIGINT:
-	default:
-		err = errors.New("bad signal no")
-	}
-
+	var runNo int
+	sig, err := killSignal(signo)
 	if err == nil {
-		err = s.kill(sig)
+		runNo, err = s.kill(sig)
 	}
 
 	redirURL := Link(fmt.Sprintf("/scripts/%d", s.ID))
@@ -441,22 +591,34 @@ func killScript(w http.ResponseWriter, r *http.Request, u user) {
 		setFlashAndRedirect(w, r, redirURL, "error", fmt.Sprintf("Could not send signal: %s", err))
 		return
 	}
+	audit(r, u, ActionKill, s.ID, runNo, url.Values{"Signal": {strconv.Itoa(signo)}})
 	setFlashAndRedirect(w, r, redirURL, "success", "Signal sent")
 }
 
+// killSignal returns the signal to send for a kill request, only the
+// signals offered in the UI are allowed.
+func killSignal(signo int) (syscall.Signal, error) {
+	sig := syscall.Signal(signo)
+	switch sig {
+	case syscall.SIGKILL, syscall.SIGTERM, syscall.SIGINT:
+		return sig, nil
+	}
+	return 0, errors.New("bad signal no")
+}
+
 func viewLog(w http.ResponseWriter, r *http.Request, u user) {
 	vars := mux.Vars(r)
 	scriptId, _ := strconv.Atoi(vars["id"])
 	runNo, _ := strconv.Atoi(vars["runno"])
 
 	var run Run
-	err := db.Debug().Where("script_id = ? AND run_no = ?", scriptId, runNo).First(&run).Error
+	err := db.Where("script_id = ? AND run_no = ?", scriptId, runNo).First(&run).Error
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	log.Printf("%r", run)
+	reqLog(r).Debug("serving log", "script_id", scriptId, "run_no", runNo, "path", run.LogFilename)
 
 	http.ServeFile(w, r, run.LogFilename)
 }
@@ -464,7 +626,7 @@ func viewLog(w http.ResponseWriter, r *http.Request, u user) {
 func manual(w http.ResponseWriter, r *http.Request, u user) {
 	flashMessages := getFlashMessages(w, r)
 
-	execTmpl(w, "manual", map[string]interface{}{
+	execTmpl(w, r, "manual", map[string]interface{}{
 		"user":          u,
 		"flashMessages": flashMessages,
 	})
@@ -473,62 +635,98 @@ func manual(w http.ResponseWriter, r *http.Request, u user) {
 func main() {
 	flag.Parse()
 
+	loadConfig()
+	initLogging()
+	initSettings()
+
+	switch flag.Arg(0) {
+	case "":
+	case "migrate":
+		openDatabase()
+		os.Exit(migrateCommand(flag.Args()[1:]))
+	case "export", "import":
+		openDatabase()
+		os.Exit(bundleCommand(flag.Arg(0), flag.Args()[1:]))
+	case "supervise":
+		os.Exit(superviseCommand(flag.Args()[1:]))
+	case "backup":
+		openDatabase()
+		os.Exit(backupCommand(flag.Args()[1:]))
+	case "restore":
+		os.Exit(restoreCommand(flag.Args()[1:]))
+	default:
+		fatal("unknown command", "command", flag.Arg(0))
+	}
+
+	initShutdown()
+	initTLS()
+	initListeners()
 	initPaths()
 	initTemplates()
-	initUsers()
+	initAuth()
 	initDatabase()
+	initMetrics()
+	initGitops()
+	initBackups()
+	go reloadOnSignal()
 
 	r := mux.NewRouter()
-
-	// TODO: limit to POST
-	r.HandleFunc("/scripts", requireLogin(newScript))
-	r.HandleFunc("/scripts/new", requireLogin(newScript))
-	r.HandleFunc("/scripts/{id:[0-9]+}", requireLogin(showScript))
-	r.HandleFunc("/scripts/{id:[0-9]+}/run", requireLogin(runScript))
-	r.HandleFunc("/scripts/{id:[0-9]+}/delete", requireLogin(deleteScript))
-	r.HandleFunc("/scripts/{id:[0-9]+}/x-schedule", scheduleScriptX)                   // TODO: put only
-	r.HandleFunc("/scripts/{id:[0-9]+}/schedule", requireLogin(scheduleScript))        // TODO: put only
-	r.HandleFunc("/scripts/{id:[0-9]+}/unschedule", requireLogin(unscheduleScript))    // TODO: put only
-	r.HandleFunc("/scripts/{id:[0-9]+}/kill/{signo:[0-9]+}", requireLogin(killScript)) // TODO: put only
-	r.HandleFunc("/scripts/{id:[0-9]+}/logs/{runno:[0-9]+}", requireLogin(viewLog))
-	r.HandleFunc("/scripts/{id:[0-9]+}/wstail", requireLogin(logWstail))
-
-	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(staticPath))))
-	r.HandleFunc("/", requireLogin(listJobs))
-	r.HandleFunc("/manual", requireLogin(manual))
+	r.Use(withRequestID)
+	r.Use(instrumentHTTP)
+
+	if *flagMetrics {
+		r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	}
+
+	// not used from a browser, and thus not subject to CSRF checks
+	r.HandleFunc("/scripts/{id:[0-9]+}/x-schedule", scheduleScriptX).Methods("PUT")
+	r.HandleFunc("/x-import", importScriptsX).Methods("PUT")
+	r.HandleFunc("/ping/{token}", pingScript).Methods("GET", "POST", "HEAD")
+	r.HandleFunc("/healthz", healthz).Methods("GET", "HEAD")
+	apiRoutes(r)
+	r.HandleFunc("/readyz", readyz).Methods("GET", "HEAD")
+
+	ui := r.NewRoute().Subrouter()
+	ui.Use(csrfProtect())
+	ui.HandleFunc("/scripts", requireLogin(newScript)).Methods("POST")
+	ui.HandleFunc("/scripts/new", requireLogin(newScript)).Methods("GET")
+	ui.HandleFunc("/scripts/{id:[0-9]+}", requireLogin(showScript)).Methods("GET", "POST")
+	ui.HandleFunc("/scripts/{id:[0-9]+}/run", requireLogin(runScript)).Methods("POST")
+	ui.HandleFunc("/scripts/{id:[0-9]+}/delete", requireLogin(deleteScript)).Methods("POST")
+	ui.HandleFunc("/scripts/{id:[0-9]+}/schedule", requireLogin(scheduleScript)).Methods("POST")
+	ui.HandleFunc("/scripts/{id:[0-9]+}/unschedule", requireLogin(unscheduleScript)).Methods("POST")
+	ui.HandleFunc("/scripts/{id:[0-9]+}/notify-test", requireLogin(notifyTestScript)).Methods("POST")
+	ui.HandleFunc("/scripts/{id:[0-9]+}/kill/{signo:[0-9]+}", requireLogin(killScript)).Methods("POST")
+	ui.HandleFunc("/scripts/{id:[0-9]+}/logs/{runno:[0-9]+}", requireLogin(viewLog)).Methods("GET")
+	ui.HandleFunc("/scripts/{id:[0-9]+}/wstail", requireLogin(logWstail)).Methods("GET")
+	ui.HandleFunc("/scripts/{id:[0-9]+}/stats", requireLogin(showStats)).Methods("GET")
+	ui.HandleFunc("/", requireLogin(listJobs)).Methods("GET")
+	ui.HandleFunc("/manual", requireLogin(manual)).Methods("GET")
+	ui.HandleFunc("/audit", requireLogin(listAudit)).Methods("GET")
+	ui.HandleFunc("/runs", requireLogin(listRuns)).Methods("GET")
+	ui.HandleFunc("/export", requireLogin(exportScripts)).Methods("GET")
+	ui.HandleFunc("/import", requireLogin(importScripts)).Methods("GET", "POST")
+	ui.HandleFunc("/login", login).Methods("GET", "POST")
+	ui.HandleFunc("/logout", logout).Methods("POST")
+	ui.HandleFunc("/auth/callback", oidcCallback).Methods("GET")
+
+	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(staticPath)))).Methods("GET")
 
 	h := http.StripPrefix(*flagBasePath, r)
 
-	var l net.Listener
-	var err error
-	addr := *flagListenAddr
-	if strings.HasPrefix(addr, "unix:") {
-		path := strings.TrimPrefix(addr, "unix:")
-		if _, err = os.Stat(path); err == nil {
-			syscall.Unlink(path)
-		}
-		l, err = net.Listen("unix", strings.TrimPrefix(addr, "unix:"))
-		if err != nil {
-			log.Fatal(err)
-		}
-		if err = os.Chmod(path, 0775); err != nil {
-			log.Printf("failed changing socket file permissions mode: %s", err)
-		}
-		if grp, err := osUser.LookupGroup("runtriggers"); err == nil {
-			gid, _ := strconv.Atoi(grp.Gid)
-			if err = os.Chown(path, os.Getuid(), gid); err != nil {
-				log.Printf("failed changing socket file group ownership: %s", err)
+	srv := &http.Server{Handler: h, TLSConfig: tlsConfig()}
+	for _, l := range serverListeners {
+		go func(l net.Listener) {
+			var err error
+			if usesTLS(l) {
+				err = srv.ServeTLS(l, "", "")
+			} else {
+				err = srv.Serve(l)
 			}
-		}
-	} else {
-		l, err = net.Listen("tcp", addr)
-	}
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	err = http.Serve(l, h)
-	if err != nil {
-		log.Fatal(err)
+			if err != http.ErrServerClosed {
+				fatal("server failed", "err", err)
+			}
+		}(l)
 	}
+	shutdownOnSignal(srv)
 }
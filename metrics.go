@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	flagMetrics = flag.Bool("metrics", false, "serve Prometheus metrics at /metrics, without authentication; they give away the names of scripts")
+)
+
+var (
+	metricRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "runtriggers_runs_total",
+		Help: "Number of finished runs by script, final state and cause.",
+	}, []string{"script_id", "script", "state", "cause"})
+
+	metricRunDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "runtriggers_run_duration_seconds",
+		Help:    "Run time of finished runs.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 4, 10),
+	}, []string{"script_id", "script"})
+
+	metricRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "runtriggers_runs_running",
+		Help: "Number of runs in progress.",
+	})
+
+	metricLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "runtriggers_last_success_timestamp_seconds",
+		Help: "Time the last successful run of the script finished.",
+	}, []string{"script_id", "script"})
+
+	metricNotificationsPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "runtriggers_notifications_pending",
+		Help: "Number of notifications being sent out, including those waiting for a retry.",
+	})
+
+	metricNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "runtriggers_notifications_total",
+		Help: "Number of notifications sent out by channel.",
+	}, []string{"channel"})
+
+	metricNotificationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "runtriggers_notification_failures_total",
+		Help: "Number of notifications given up on by channel.",
+	}, []string{"channel"})
+
+	metricHTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "runtriggers_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "runtriggers_queued_runs",
+		Help: "Number of manual runs and pings waiting for the script to be free.",
+	}, func() float64 {
+		var n int
+		for _, s := range allScripts.get() {
+			n += len(s.manualch) + len(s.pingch)
+		}
+		return float64(n)
+	})
+}
+
+func scriptLabels(s *Script) prometheus.Labels {
+	return prometheus.Labels{"script_id": strconv.Itoa(s.ID), "script": s.Name}
+}
+
+// observeRun updates the metrics for a finished run.
+func observeRun(s *Script, r Run) {
+	metricRuns.WithLabelValues(strconv.Itoa(s.ID), s.Name, stateName(r.State), r.Cause.String()).Inc()
+	if r.State == StateDone && r.FinishTime != nil {
+		metricLastSuccess.With(scriptLabels(s)).Set(float64(r.FinishTime.Unix()))
+	}
+}
+
+// forgetScript drops the series of a deleted script.
+func forgetScript(s *Script) {
+	labels := prometheus.Labels{"script_id": strconv.Itoa(s.ID)}
+	metricRuns.DeletePartialMatch(labels)
+	metricRunDuration.DeletePartialMatch(labels)
+	metricLastSuccess.DeletePartialMatch(labels)
+}
+
+// initMetrics fills in the time of the last successful run of every script,
+// which would otherwise be missing until the script next succeeds.
+func initMetrics() {
+	for _, s := range allScripts.get() {
+		var r Run
+		if db.Where("script_id = ? AND state = ?", s.ID, StateDone).Order("run_no desc").First(&r).Error == nil && r.FinishTime != nil {
+			metricLastSuccess.With(scriptLabels(s)).Set(float64(r.FinishTime.Unix()))
+		}
+	}
+}
+
+// instrumentHTTP is a middleware measuring request latencies by route.
+func instrumentHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "other"
+		if cur := mux.CurrentRoute(r); cur != nil {
+			if tmpl, err := cur.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		obs := metricHTTPDuration.MustCurryWith(prometheus.Labels{"route": route})
+		promhttp.InstrumentHandlerDuration(obs, next).ServeHTTP(w, r)
+	})
+}
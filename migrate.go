@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// migration changes the database schema from the previous version to the
+// next one, and back. Migrations refer to frozen copies of the models, not
+// the ones the rest of runtriggers uses, so that they keep doing the same
+// thing as the models evolve.
+type migration struct {
+	name string
+	up   func(tx *gorm.DB) error
+	down func(tx *gorm.DB) error
+}
+
+// migrations lists all migrations in order. The schema version is the
+// number of migrations applied. Only ever append to this list.
+var migrations = []migration{
+	{"initial schema", migrateInitialUp, migrateInitialDown},
+	{"drop scripts.email_notification", migrateDropEmailNotificationUp, migrateDropEmailNotificationDown},
+	{"add git commits of scripts and runs", migrateGitUp, migrateGitDown},
+	{"add parameters of runs", migrateRunParamsUp, migrateRunParamsDown},
+	{"add orphaned flag of scripts from git", migrateGitOrphanedUp, migrateGitOrphanedDown},
+}
+
+// schemaVersion is a row of the schema_version table, one for every
+// migration applied.
+type schemaVersion struct {
+	Version   int `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (schemaVersion) TableName() string {
+	return "schema_version"
+}
+
+func schemaVersionOf(db *gorm.DB) (int, error) {
+	if err := db.AutoMigrate(&schemaVersion{}).Error; err != nil {
+		return 0, err
+	}
+	var current int
+	err := db.Model(&schemaVersion{}).Select("COALESCE(MAX(version), 0)").Row().Scan(&current)
+	return current, err
+}
+
+// migrateTo applies or rolls back migrations until the schema is at the
+// given version. Every migration runs in a transaction of its own.
+func migrateTo(db *gorm.DB, target int) error {
+	current, err := schemaVersionOf(db)
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("schema version %d is newer than the latest known, %d", current, len(migrations))
+	}
+	if target < 0 || target > len(migrations) {
+		return fmt.Errorf("no schema version %d, the latest is %d", target, len(migrations))
+	}
+
+	for current != target {
+		version := current + 1
+		if target < current {
+			version = current
+		}
+		m := migrations[version-1]
+		step := m.up
+		if target < current {
+			step = m.down
+		}
+
+		tx := db.Begin()
+		if err := step(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %v", version, m.name, err)
+		}
+		if target > current {
+			err = tx.Create(&schemaVersion{Version: version, Name: m.name, AppliedAt: time.Now()}).Error
+		} else {
+			err = tx.Delete(&schemaVersion{Version: version}).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %v", version, m.name, err)
+		}
+		if err := tx.Commit().Error; err != nil {
+			return fmt.Errorf("migration %d (%s): %v", version, m.name, err)
+		}
+
+		if target > current {
+			slog.Info("applied migration", "version", version, "name", m.name)
+			current++
+		} else {
+			slog.Info("rolled back migration", "version", version, "name", m.name)
+			current--
+		}
+	}
+	return nil
+}
+
+// migrateCommand implements the migrate subcommand and returns the exit
+// status.
+func migrateCommand(args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "usage: runtriggers [flags] migrate up [VERSION] | down [VERSION] | status")
+		return 2
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return usage()
+	}
+
+	current, err := schemaVersionOf(db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to read schema version:", err)
+		return 1
+	}
+
+	var target int
+	switch args[0] {
+	case "up":
+		target = len(migrations)
+	case "down":
+		target = current - 1
+	case "status":
+		if len(args) > 1 {
+			return usage()
+		}
+		return migrateStatus(current)
+	default:
+		return usage()
+	}
+	if len(args) > 1 {
+		if target, err = strconv.Atoi(args[1]); err != nil {
+			return usage()
+		}
+		if args[0] == "up" && target < current || args[0] == "down" && target > current {
+			fmt.Fprintf(os.Stderr, "schema is at version %d, cannot migrate %s to %d\n", current, args[0], target)
+			return 1
+		}
+	}
+
+	if err := migrateTo(db, target); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func migrateStatus(current int) int {
+	var applied []schemaVersion
+	if err := db.Order("version").Find(&applied).Error; err != nil {
+		fmt.Fprintln(os.Stderr, "failed to read schema versions:", err)
+		return 1
+	}
+	appliedAt := make(map[int]time.Time)
+	for _, v := range applied {
+		appliedAt[v.Version] = v.AppliedAt
+	}
+
+	fmt.Printf("schema version %d, latest %d\n", current, len(migrations))
+	for i, m := range migrations {
+		state := "pending"
+		if t, ok := appliedAt[i+1]; ok {
+			state = "applied " + t.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%4d  %-27s  %s\n", i+1, state, m.name)
+	}
+	if current > len(migrations) {
+		fmt.Println("the database has migrations unknown to this version of runtriggers")
+	}
+	return 0
+}
+
+// dropColumns drops columns, which the SQLite shipped with the driver
+// cannot do with ALTER TABLE. There, the table is copied into a new one
+// made from the model without the columns instead.
+func dropColumns(tx *gorm.DB, table string, model interface{}, columns ...string) error {
+	if tx.Dialect().GetName() != "sqlite3" {
+		for _, column := range columns {
+			if err := tx.Table(table).DropColumn(column).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tmp := table + "_new"
+	if err := tx.Table(tmp).CreateTable(model).Error; err != nil {
+		return err
+	}
+	var cols []string
+	for _, f := range tx.NewScope(model).GetModelStruct().StructFields {
+		if f.IsNormal && !f.IsIgnored {
+			cols = append(cols, f.DBName)
+		}
+	}
+	list := strings.Join(cols, ", ")
+	if err := tx.Exec("INSERT INTO " + tmp + " (" + list + ") SELECT " + list + " FROM " + table).Error; err != nil {
+		return err
+	}
+	if err := tx.DropTable(table).Error; err != nil {
+		return err
+	}
+	return tx.Exec("ALTER TABLE " + tmp + " RENAME TO " + table).Error
+}
+
+// The tables as they were before migrations were introduced, when they were
+// kept up to date by AutoMigrate.
+
+type scriptV1 struct {
+	ID         int `gorm:"primary_key"`
+	Owner      string
+	Text       string
+	RunCounter int
+
+	Name                        string
+	Kind                        string
+	RunPeriod                   string
+	PeriodicRunsEnabled         bool
+	ScheduledRunsEnabled        bool
+	AutomaticRunsDisableOnError bool
+	MisfirePolicy               string
+	MisfireThreshold            string
+
+	NotifyOnFailure     bool
+	NotifyOnRecovery    bool
+	NotifyOnEveryRun    bool
+	NotifyAfterFailures int
+	NotifyQuietPeriod   string
+	EmailAddress        string
+
+	WebhookURL    string
+	WebhookFormat string
+	WebhookSecret string
+
+	HeartbeatPeriod string
+	HeartbeatGrace  string
+	PingToken       string
+
+	Scheduled *time.Time
+
+	FailureStreak int
+	LastNotified  *time.Time
+}
+
+type runV1 struct {
+	Scheduled *time.Time
+
+	StartTime  time.Time
+	FinishTime *time.Time
+	ExitCode   int
+	State      int
+
+	LogFilename string
+
+	Cause       int
+	TriggeredBy string
+
+	ScriptID int `gorm:"primary_key;auto_increment:false"`
+	RunNo    int `gorm:"primary_key;auto_increment:false"`
+}
+
+type auditEntryV1 struct {
+	ID         int `gorm:"primary_key"`
+	Time       time.Time
+	Actor      string
+	Action     string
+	ScriptID   int
+	RunNo      int
+	Params     string
+	RemoteAddr string
+}
+
+// migrateInitialUp creates the tables, or brings the ones created by
+// earlier versions of runtriggers up to date. Those may still have the
+// email_notification column, which the next migration takes care of.
+func migrateInitialUp(tx *gorm.DB) error {
+	if err := tx.Table("scripts").AutoMigrate(&scriptV1{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Table("runs").AutoMigrate(&runV1{}).Error; err != nil {
+		return err
+	}
+	return tx.Table("audit_entries").AutoMigrate(&auditEntryV1{}).Error
+}
+
+func migrateInitialDown(tx *gorm.DB) error {
+	return tx.DropTableIfExists("audit_entries", "runs", "scripts").Error
+}
+
+// notification rules replaced the single "email once on anomaly" flag
+func migrateDropEmailNotificationUp(tx *gorm.DB) error {
+	if !tx.Dialect().HasColumn("scripts", "email_notification") {
+		return nil
+	}
+	err := tx.Exec("UPDATE scripts SET notify_on_failure=email_notification WHERE email_notification IS NOT NULL").Error
+	if err != nil {
+		return err
+	}
+	return dropColumns(tx, "scripts", &scriptV1{}, "email_notification")
+}
+
+func migrateDropEmailNotificationDown(tx *gorm.DB) error {
+	return tx.Exec("ALTER TABLE scripts ADD COLUMN email_notification boolean").Error
+}
+
+type scriptGitV3 struct {
+	GitPath   string
+	GitCommit string
+}
+
+type runGitV3 struct {
+	GitCommit string
+}
+
+func migrateGitUp(tx *gorm.DB) error {
+	if err := tx.Table("scripts").AutoMigrate(&scriptGitV3{}).Error; err != nil {
+		return err
+	}
+	return tx.Table("runs").AutoMigrate(&runGitV3{}).Error
+}
+
+func migrateGitDown(tx *gorm.DB) error {
+	if err := dropColumns(tx, "scripts", &scriptV1{}, "git_path", "git_commit"); err != nil {
+		return err
+	}
+	return dropColumns(tx, "runs", &runV1{}, "git_commit")
+}
+
+type runV3 struct {
+	V1        runV1 `gorm:"embedded"`
+	GitCommit string
+}
+
+type runParamsV4 struct {
+	Params string
+}
+
+func migrateRunParamsUp(tx *gorm.DB) error {
+	return tx.Table("runs").AutoMigrate(&runParamsV4{}).Error
+}
+
+func migrateRunParamsDown(tx *gorm.DB) error {
+	return dropColumns(tx, "runs", &runV3{}, "params")
+}
+
+type scriptV3 struct {
+	V1        scriptV1 `gorm:"embedded"`
+	GitPath   string
+	GitCommit string
+}
+
+type scriptGitOrphanedV5 struct {
+	GitOrphaned bool
+}
+
+func migrateGitOrphanedUp(tx *gorm.DB) error {
+	return tx.Table("scripts").AutoMigrate(&scriptGitOrphanedV5{}).Error
+}
+
+func migrateGitOrphanedDown(tx *gorm.DB) error {
+	return dropColumns(tx, "scripts", &scriptV3{}, "git_orphaned")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// testDB opens a database with the latest schema as db for the test. It is
+// an sqlite database, or, if RT_TEST_POSTGRES_DSN is set, a schema of its
+// own in that Postgres database.
+func testDB(t *testing.T) {
+	var err error
+	old := db
+	t.Cleanup(func() { db = old })
+
+	if dsn := os.Getenv("RT_TEST_POSTGRES_DSN"); dsn != "" {
+		var admin *gorm.DB
+		if admin, err = gorm.Open("postgres", dsn); err != nil {
+			t.Fatal(err)
+		}
+		schema := fmt.Sprintf("runtriggers_test_%d", time.Now().UnixNano())
+		if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+			admin.Close()
+		})
+		db, err = gorm.Open("postgres", dsn+" search_path="+schema)
+	} else {
+		db, err = gorm.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetLogger(gormLogger{})
+
+	if err := migrateTo(db, len(migrations)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	testDB(t)
+
+	s := Script{Name: "backup", Owner: "alice", Kind: KindScript, Text: "echo hi"}
+	if err := db.Create(&s).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&Run{ScriptID: s.ID, RunNo: 1, StartTime: time.Now(), Params: "a=1"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// every migration rolls back and applies again, keeping the data
+	for version := len(migrations) - 1; version >= 1; version-- {
+		if err := migrateTo(db, version); err != nil {
+			t.Fatal(err)
+		}
+		if current, err := schemaVersionOf(db); err != nil || current != version {
+			t.Fatalf("schema version %d, %v, want %d", current, err, version)
+		}
+		var name string
+		if err := db.Table("scripts").Select("name").Where("id = ?", s.ID).Row().Scan(&name); err != nil || name != s.Name {
+			t.Fatalf("version %d: script %q, %v", version, name, err)
+		}
+	}
+	if err := migrateTo(db, len(migrations)); err != nil {
+		t.Fatal(err)
+	}
+	var got Script
+	if err := db.First(&got, s.ID).Error; err != nil || got.Name != s.Name {
+		t.Fatalf("script after migrating up again: %+v, %v", got, err)
+	}
+	var runs int
+	db.Model(&Run{}).Where("script_id = ?", s.ID).Count(&runs)
+	if runs != 1 {
+		t.Errorf("%d runs after migrating up again", runs)
+	}
+
+	if err := migrateTo(db, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"scripts", "runs"} {
+		if db.HasTable(table) {
+			t.Errorf("table %s left at version 0", table)
+		}
+	}
+
+	if err := migrateTo(db, len(migrations)+1); err == nil {
+		t.Error("migrated to an unknown version")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+var flagMisfireCatchUpMax = flag.Int("misfire-catch-up-max", 10, "most missed periodic runs the \"all\" misfire policy catches up on, older ones are skipped; 0 for no limit")
+
+// Misfire policies decide what happens to scheduled and periodic runs which
+// could not start on time, typically because runtriggers was not running.
+const (
+	MisfireRunOnce = "once"
+	MisfireRunAll  = "all"
+	MisfireSkip    = "skip"
+)
+
+var misfirePolicies = []string{MisfireRunOnce, MisfireRunAll, MisfireSkip}
+
+// defaultMisfireThreshold is how late a run may start before the misfire
+// policy applies, unless the script sets its own threshold.
+const defaultMisfireThreshold = time.Minute
+
+func (s *Script) misfireThreshold() time.Duration {
+	if d, err := time.ParseDuration(s.MisfireThreshold); err == nil {
+		return d
+	}
+	return defaultMisfireThreshold
+}
+
+// misfire starts a scheduled or periodic run due at planned, applying the
+// script's misfire policy if the run is late. period is the run period for
+// periodic runs.
+func (s *Script) misfire(cause Cause, planned time.Time, period time.Duration) {
+	late := time.Since(planned)
+	if late < s.misfireThreshold() {
+		s.run(cause, trigger{}, &planned)
+		return
+	}
+
+	// a periodic script may have missed more than one run, latest is the
+	// planned time of the last one
+	latest := planned
+	missed := 1
+	if cause == CausePeriodic && period > 0 {
+		latest = planned.Add(late / period * period)
+		missed += int(late / period)
+	}
+
+	l := s.logger().With("cause", cause.String(), "planned", planned, "late", late)
+	switch s.MisfirePolicy {
+	case MisfireRunAll:
+		if limit := *flagMisfireCatchUpMax; limit > 0 && missed > limit {
+			// the loop comes back right away for the first run caught
+			// up on, planned one period after the last one skipped
+			skipped := missed - limit
+			lastSkipped := latest.Add(-time.Duration(limit) * period)
+			l.Warn("run is late, skipping missed runs beyond the catch-up limit", "missed", missed, "skipped", skipped)
+			s.record(Run{Scheduled: &lastSkipped, Cause: cause, State: StateSkipped},
+				fmt.Sprintf("runtriggers: skipped %d run(s) planned since %s, catching up on the last %d only\n",
+					skipped, planned.Format(time.RFC3339), limit))
+			return
+		}
+		// the loop comes back for the remaining runs right away, their
+		// planned times are past too
+		l.Warn("run is late, catching up on missed runs", "missed", missed)
+		s.run(cause, trigger{}, &planned)
+	case MisfireSkip:
+		l.Warn("run is late, skipping missed runs", "missed", missed)
+		if cause == CauseScheduled {
+			s.Scheduled = nil
+		}
+		s.record(Run{Scheduled: &latest, Cause: cause, State: StateSkipped},
+			fmt.Sprintf("runtriggers: skipped %d run(s) planned since %s\n", missed, planned.Format(time.RFC3339)))
+	default:
+		l.Warn("run is late, running once for missed runs", "missed", missed)
+		s.run(cause, trigger{}, &latest)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMisfireCatchUpLimit(t *testing.T) {
+	testDB(t)
+	setFlag(t, flagLogDir, t.TempDir())
+	old := *flagMisfireCatchUpMax
+	*flagMisfireCatchUpMax = 3
+	t.Cleanup(func() { *flagMisfireCatchUpMax = old })
+
+	s := &Script{Name: "sync", Owner: "alice", Kind: KindScript, MisfirePolicy: MisfireRunAll, changech: make(chan struct{})}
+	if err := db.Create(s).Error; err != nil {
+		t.Fatal(err)
+	}
+	// 10 missed runs, the last one planned a few seconds ago
+	planned := time.Now().Add(-9*time.Minute - 5*time.Second).Truncate(time.Second)
+	s.misfire(CausePeriodic, planned, time.Minute)
+
+	var runs []Run
+	if err := db.Where("script_id = ?", s.ID).Find(&runs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].State != StateSkipped {
+		t.Fatalf("got runs %+v, want one skipped run", runs)
+	}
+	// 7 runs skipped, the next planned one is the first of the last 3
+	want := planned.Add(6 * time.Minute)
+	if got := runs[0].Scheduled; got == nil || !got.Equal(want) {
+		t.Errorf("last skipped run planned at %v, want %v", got, want)
+	}
+	if next := runs[0].Scheduled.Add(time.Minute); time.Since(next) < 2*time.Minute {
+		t.Errorf("first run caught up on planned at %v, too recent for 3 runs", next)
+	}
+}
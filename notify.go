@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	flagNotifyTemplates = flag.String("notify-templates", "", "directory with notification templates overriding the built-in ones (<event>.txt, or scripts/<id>/<event>.txt for a single script)")
+	flagNotifyLogLines  = flag.Int("notify-log-lines", 20, "number of lines from the end of the run's log available to notification templates as LogExcerpt")
+)
+
+// Events which notifications are sent out about.
+const (
+	EventAnomalous   = "anomalous"
+	EventInterrupted = "interrupted"
+	EventRecovered   = "recovered"
+	EventFinished    = "finished"
+)
+
+// notification is the data notification templates are executed with.
+type notification struct {
+	Event  string
+	Script Script
+	Run    Run
+
+	State      string
+	Cause      string
+	ExitCode   int
+	LogExcerpt string
+	LogURL     string
+	ScriptURL  string
+
+	// Failures is the number of consecutive anomalous runs preceding a
+	// recovery.
+	Failures int
+	// Test is set for notifications sent from the script page.
+	Test bool
+}
+
+// stateName names the run's state in notifications. Successful runs show no
+// state in the UI, which would leave a blank here.
+func stateName(st State) string {
+	if st == StateDone {
+		return "done"
+	}
+	return st.String()
+}
+
+func newNotification(event string, s Script, r Run, failures int) notification {
+	return notification{
+		Event:      event,
+		Script:     s,
+		Run:        r,
+		State:      stateName(r.State),
+		Cause:      r.Cause.String(),
+		ExitCode:   r.ExitCode,
+		LogExcerpt: strings.Join(logTail(r.LogFilename, cfg().notifyLogLines), "\n"),
+		LogURL:     backLink(fmt.Sprintf("/scripts/%d/logs/%d", s.ID, r.RunNo)),
+		ScriptURL:  backLink(fmt.Sprintf("/scripts/%d", s.ID)),
+		Failures:   failures,
+	}
+}
+
+// permanentError is an error which trying again would not fix.
+type permanentError struct {
+	error
+}
+
+// retry calls f until it succeeds or has been retried the given number of
+// times, doubling the delay between attempts. Permanent errors are not
+// retried. onFailure is told about each failure which is going to be
+// retried.
+func retry(retries int, delay time.Duration, onFailure func(attempt int, err error, delay time.Duration), f func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = f(); err == nil {
+			return nil
+		}
+		if _, ok := err.(permanentError); ok || attempt >= retries {
+			return err
+		}
+		onFailure(attempt+1, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// quiet tells if failure notifications are held back because one has been
+// sent out recently.
+func (s *Script) quiet(now time.Time) bool {
+	if s.LastNotified == nil || s.NotifyQuietPeriod == "" {
+		return false
+	}
+	period, err := time.ParseDuration(s.NotifyQuietPeriod)
+	if err != nil {
+		return false
+	}
+	return now.Before(s.LastNotified.Add(period))
+}
+
+// notificationFor applies the script's notification rules to a finished run.
+// It updates the script's count of consecutive failures and the time of the
+// last notification, and returns the event to notify about, if any. The
+// caller is expected to save the script.
+func (s *Script) notificationFor(r Run, now time.Time) (string, bool) {
+	failed := r.State != StateDone
+	failures := s.FailureStreak
+
+	var event string
+	if failed {
+		s.FailureStreak++
+		event = EventAnomalous
+		if r.State == StateInterrupted {
+			event = EventInterrupted
+		}
+	} else {
+		s.FailureStreak = 0
+		event = EventFinished
+	}
+
+	threshold := s.NotifyAfterFailures
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	var notify bool
+	switch {
+	case s.NotifyOnEveryRun:
+		notify = true
+	case failed:
+		notify = s.NotifyOnFailure && s.FailureStreak >= threshold && !s.quiet(now)
+	case failures > 0:
+		event = EventRecovered
+		notify = s.NotifyOnRecovery
+	}
+
+	if notify && failed {
+		s.LastNotified = &now
+	}
+	return event, notify
+}
+
+// pendingNotifications tracks notifications being sent, for shutdown to
+// wait for.
+var pendingNotifications sync.WaitGroup
+
+// notify sends out a notification over the channels configured for the
+// script. failures is the number of consecutive failed runs preceding a
+// recovery.
+func notify(event string, s Script, r Run, failures int) {
+	if s.EmailAddress != "" {
+		metricNotificationsPending.Inc()
+		pendingNotifications.Add(1)
+		go func() {
+			defer pendingNotifications.Done()
+			defer metricNotificationsPending.Dec()
+			emailNotification(newNotification(event, s, r, failures))
+		}()
+	}
+	if s.WebhookURL != "" {
+		metricNotificationsPending.Inc()
+		pendingNotifications.Add(1)
+		go func() {
+			defer pendingNotifications.Done()
+			defer metricNotificationsPending.Dec()
+			notifyWebhook(event, s, r)
+		}()
+	}
+}
+
+// waitForNotifications waits until the notifications being sent are out,
+// including their retries, and tells if they were before the timeout.
+func waitForNotifications(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		pendingNotifications.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// testNotification synchronously sends a notification about the script's
+// latest run over all of its channels, without retrying. A made up failed
+// run is used if the script has not run yet.
+func testNotification(s Script) error {
+	if s.EmailAddress == "" && s.WebhookURL == "" {
+		return errors.New("no email address or webhook configured")
+	}
+
+	var r Run
+	if db.Where("script_id = ?", s.ID).Order("run_no desc").First(&r).Error != nil {
+		now := time.Now()
+		r = Run{
+			ScriptID:   s.ID,
+			StartTime:  now,
+			FinishTime: &now,
+			ExitCode:   1,
+			State:      StateNonzeroCode,
+			Cause:      CauseManual,
+		}
+	}
+
+	event := EventAnomalous
+	switch r.State {
+	case StateDone:
+		event = EventFinished
+	case StateInterrupted:
+		event = EventInterrupted
+	}
+
+	var errs []string
+	if s.EmailAddress != "" {
+		n := newNotification(event, s, r, s.FailureStreak)
+		n.Test = true
+		m, err := renderEmail(n)
+		if err == nil {
+			err = deliver(m, 0)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("email: %s", err))
+		}
+	}
+	if s.WebhookURL != "" {
+		body, err := newWebhookPayload(event, s, r).format(s.WebhookFormat)
+		if err == nil {
+			err = postWebhook(s.WebhookURL, s.WebhookSecret, body)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("webhook: %s", err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
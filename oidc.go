@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	osUser "os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+var (
+	flagOIDCIssuer           = flag.String("oidc-issuer", "", "URL of the OpenID Connect provider (oidc authentication)")
+	flagOIDCClientID         = flag.String("oidc-client-id", "", "OpenID Connect client ID")
+	flagOIDCClientSecretFile = flag.String("oidc-client-secret-file", "", "path to a file with the OpenID Connect client secret")
+	flagOIDCUsernameClaim    = flag.String("oidc-username-claim", "preferred_username", "ID token claim to take the username from")
+	flagOIDCScopes           = flag.String("oidc-scopes", "profile,email", "comma-separated list of scopes to request in addition to openid")
+	flagOIDCAllowedUsers     = flag.String("oidc-allowed-users", "", "comma-separated list of usernames allowed to log in with OpenID Connect, empty for any")
+	flagOIDCMinUID           = flag.Int("oidc-min-uid", 1000, "lowest uid of a local account OpenID Connect users may log in as")
+)
+
+const (
+	oidcStateCookie = "runtriggers_oidc"
+	oidcLoginMaxAge = 10 * time.Minute
+)
+
+type oidcAuth struct {
+	config   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// oidcState is kept in a cookie between the redirect to the provider and
+// the callback.
+type oidcState struct {
+	State string
+	Nonce string
+	Next  string
+}
+
+func newOIDCAuth() (*oidcAuth, error) {
+	if *flagOIDCIssuer == "" || *flagOIDCClientID == "" {
+		return nil, errors.New("-oidc-issuer and -oidc-client-id are required")
+	}
+	if *flagBacklink == "" {
+		return nil, errors.New("-backlink is required to construct the OpenID Connect redirect URL")
+	}
+
+	var secret string
+	if *flagOIDCClientSecretFile != "" {
+		content, err := ioutil.ReadFile(*flagOIDCClientSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		secret = strings.TrimSpace(string(content))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, *flagOIDCIssuer)
+	if err != nil {
+		return nil, fmt.Errorf("discovering provider %s: %s", *flagOIDCIssuer, err)
+	}
+
+	scopes := []string{oidc.ScopeOpenID}
+	for _, scope := range strings.Split(*flagOIDCScopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return &oidcAuth{
+		config: oauth2.Config{
+			ClientID:     *flagOIDCClientID,
+			ClientSecret: secret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  backLink("/auth/callback"),
+			Scopes:       scopes,
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: *flagOIDCClientID}),
+	}, nil
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (o *oidcAuth) redirect(w http.ResponseWriter, r *http.Request, next string) {
+	state := oidcState{
+		State: randomString(),
+		Nonce: randomString(),
+		Next:  next,
+	}
+	if err := setCookie(w, oidcStateCookie, state, oidcLoginMaxAge); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	http.Redirect(w, r, o.config.AuthCodeURL(state.State, oidc.Nonce(state.Nonce)), http.StatusFound)
+}
+
+func (o *oidcAuth) finish(r *http.Request, state oidcState) (user, error) {
+	if r.URL.Query().Get("state") != state.State {
+		return "", errors.New("state mismatch")
+	}
+	if msg := r.URL.Query().Get("error"); msg != "" {
+		return "", fmt.Errorf("provider returned error: %s %s", msg, r.URL.Query().Get("error_description"))
+	}
+
+	token, err := o.config.Exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		return "", fmt.Errorf("exchanging code: %s", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", errors.New("no id_token in token response")
+	}
+	idToken, err := o.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		return "", fmt.Errorf("verifying ID token: %s", err)
+	}
+	if idToken.Nonce != state.Nonce {
+		return "", errors.New("nonce mismatch")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return "", err
+	}
+	username, _ := claims[*flagOIDCUsernameClaim].(string)
+	if username == "" {
+		return "", fmt.Errorf("ID token has no %q claim", *flagOIDCUsernameClaim)
+	}
+	if err := checkOIDCUsername(username); err != nil {
+		return "", err
+	}
+	return user(username), nil
+}
+
+// checkOIDCUsername refuses usernames scripts must not run as. Claims like
+// preferred_username can be changed by users at many providers, and scripts
+// run as their owner with su-exec, which also takes uids and user:group.
+func checkOIDCUsername(username string) error {
+	if allowed := parseUsers(*flagOIDCAllowedUsers); len(allowed) > 0 && !allowed[user(username)] {
+		return fmt.Errorf("user %q is not in -oidc-allowed-users", username)
+	}
+	if strings.ContainsAny(username, ":/") || strings.HasPrefix(username, "-") {
+		return fmt.Errorf("invalid username %q", username)
+	}
+	if _, err := strconv.Atoi(username); err == nil {
+		return fmt.Errorf("numeric username %q", username)
+	}
+	if u, err := osUser.Lookup(username); err == nil {
+		if uid, err := strconv.Atoi(u.Uid); err != nil || uid == 0 || uid < *flagOIDCMinUID {
+			return fmt.Errorf("user %q is a system account (uid %s)", username, u.Uid)
+		}
+	}
+	return nil
+}
+
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	a, ok := auth.(*sessionAuth)
+	if !ok || a.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var state oidcState
+	if err := getCookie(r, oidcStateCookie, &state); err != nil {
+		http.Error(w, "login expired, please try again", 400)
+		return
+	}
+	clearCookie(w, oidcStateCookie)
+
+	u, err := a.oidc.finish(r, state)
+	if err == nil {
+		err = startSession(w, u)
+	}
+	if err != nil {
+		reqLog(r).Warn("OpenID Connect login failed", "err", err)
+		http.Error(w, "login failed", 403)
+		return
+	}
+
+	reqLog(r).Info("user logged in", "user", u)
+	http.Redirect(w, r, Link(safeNext(state.Next)), http.StatusFound)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// fakeIdP is an OpenID Connect provider issuing ID tokens for alice, or
+// the username it is told, on the code "good", with the nonce it is told.
+type fakeIdP struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	nonce    string
+	username string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeIdP{key: key, username: "alice"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/auth",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     p.idToken(t),
+		})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *fakeIdP) idToken(t *testing.T) string {
+	enc := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	now := time.Now()
+	signed := enc(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"}) + "." + enc(map[string]interface{}{
+		"iss":                p.URL,
+		"aud":                "runtriggers",
+		"sub":                "1234",
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"nonce":              p.nonce,
+		"preferred_username": p.username,
+	})
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func setFlag(t *testing.T, p *string, value string) {
+	old := *p
+	*p = value
+	t.Cleanup(func() { *p = old })
+}
+
+func TestOIDC(t *testing.T) {
+	idp := newFakeIdP(t)
+	setFlag(t, flagOIDCIssuer, idp.URL)
+	setFlag(t, flagOIDCClientID, "runtriggers")
+	setFlag(t, flagBacklink, "https://rt.example")
+	initSessions()
+	o, err := newOIDCAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldAuth := auth
+	auth = &sessionAuth{oidc: o}
+	t.Cleanup(func() { auth = oldAuth })
+
+	// login redirects to the provider, keeping state and nonce in a cookie
+	login := func() (*http.Cookie, url.Values) {
+		w := httptest.NewRecorder()
+		o.redirect(w, httptest.NewRequest("GET", "/login", nil), "/scripts/1")
+		if w.Code != http.StatusFound {
+			t.Fatalf("login: status %d", w.Code)
+		}
+		loc, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := loc.Query()
+		if loc.Path != "/auth" || q.Get("client_id") != "runtriggers" || q.Get("redirect_uri") != "https://rt.example/auth/callback" {
+			t.Fatalf("login: redirected to %s", loc)
+		}
+		for _, c := range w.Result().Cookies() {
+			if c.Name == oidcStateCookie {
+				return c, q
+			}
+		}
+		t.Fatal("login: no state cookie")
+		return nil, nil
+	}
+	callback := func(cookie *http.Cookie, query url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/auth/callback?"+query.Encode(), nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		oidcCallback(w, r)
+		return w
+	}
+
+	t.Run("success", func(t *testing.T) {
+		cookie, q := login()
+		idp.nonce = q.Get("nonce")
+		w := callback(cookie, url.Values{"state": {q.Get("state")}, "code": {"good"}})
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/scripts/1" {
+			t.Fatalf("status %d, location %q, body %q", w.Code, w.Header().Get("Location"), w.Body)
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		if u, err := auth.authenticate(r); u != "alice" || err != nil {
+			t.Errorf("session: %q, %v", u, err)
+		}
+	})
+
+	for _, tc := range []struct {
+		name   string
+		status int
+		call   func() *httptest.ResponseRecorder
+	}{
+		{"state mismatch", 403, func() *httptest.ResponseRecorder {
+			cookie, q := login()
+			idp.nonce = q.Get("nonce")
+			return callback(cookie, url.Values{"state": {"forged"}, "code": {"good"}})
+		}},
+		{"nonce mismatch", 403, func() *httptest.ResponseRecorder {
+			cookie, q := login()
+			idp.nonce = "replayed"
+			return callback(cookie, url.Values{"state": {q.Get("state")}, "code": {"good"}})
+		}},
+		{"bad code", 403, func() *httptest.ResponseRecorder {
+			cookie, q := login()
+			idp.nonce = q.Get("nonce")
+			return callback(cookie, url.Values{"state": {q.Get("state")}, "code": {"bad"}})
+		}},
+		{"provider error", 403, func() *httptest.ResponseRecorder {
+			cookie, q := login()
+			return callback(cookie, url.Values{"state": {q.Get("state")}, "error": {"access_denied"}})
+		}},
+		{"root", 403, func() *httptest.ResponseRecorder {
+			cookie, q := login()
+			idp.nonce = q.Get("nonce")
+			idp.username = "root"
+			defer func() { idp.username = "alice" }()
+			return callback(cookie, url.Values{"state": {q.Get("state")}, "code": {"good"}})
+		}},
+		{"no state cookie", 400, func() *httptest.ResponseRecorder {
+			_, q := login()
+			idp.nonce = q.Get("nonce")
+			return callback(nil, url.Values{"state": {q.Get("state")}, "code": {"good"}})
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := tc.call()
+			if w.Code != tc.status {
+				t.Errorf("status %d, want %d", w.Code, tc.status)
+			}
+			for _, c := range w.Result().Cookies() {
+				if c.Name == sessionCookie && c.MaxAge >= 0 {
+					t.Error("session started")
+				}
+			}
+		})
+	}
+}
+
+func TestCheckOIDCUsername(t *testing.T) {
+	for _, name := range []string{"root", "daemon", "0", "1000:0", "-u", "../alice"} {
+		if err := checkOIDCUsername(name); err == nil {
+			t.Errorf("%q accepted", name)
+		}
+	}
+	if err := checkOIDCUsername("alice"); err != nil {
+		t.Errorf("alice refused: %v", err)
+	}
+
+	setFlag(t, flagOIDCAllowedUsers, "bob, carol")
+	if err := checkOIDCUsername("alice"); err == nil {
+		t.Error("alice accepted despite -oidc-allowed-users")
+	}
+	if err := checkOIDCUsername("carol"); err != nil {
+		t.Errorf("carol refused: %v", err)
+	}
+}
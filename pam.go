@@ -0,0 +1,44 @@
+//go:build pam
+
+package main
+
+import (
+	"errors"
+
+	"github.com/msteinert/pam/v2"
+)
+
+const pamSupported = true
+
+// pamAuth checks passwords through the PAM stack of the given service.
+// Building it needs cgo and the PAM headers, enable it with -tags pam.
+type pamAuth struct {
+	service string
+}
+
+func (a *pamAuth) checkPassword(username, password string) error {
+	t, err := pam.StartFunc(a.service, username, func(style pam.Style, msg string) (string, error) {
+		switch style {
+		case pam.PromptEchoOff:
+			return password, nil
+		case pam.PromptEchoOn:
+			return username, nil
+		case pam.ErrorMsg, pam.TextInfo:
+			return "", nil
+		default:
+			return "", errors.New("unrecognized PAM message style")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer t.End()
+
+	if err := t.Authenticate(pam.DisallowNullAuthtok); err != nil {
+		return errBadCredentials
+	}
+	if err := t.AcctMgmt(pam.DisallowNullAuthtok); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !pam
+
+package main
+
+import (
+	"errors"
+)
+
+const pamSupported = false
+
+type pamAuth struct {
+	service string
+}
+
+func (a *pamAuth) checkPassword(username, password string) error {
+	return errors.New("runtriggers built without PAM support, rebuild with -tags pam")
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const runsPageSize = 50
+
+// runSortColumns maps the sort keys of the runs browser to columns. Runs
+// are further ordered by start time and primary key, so that every run has
+// a unique position to continue a page from.
+var runSortColumns = map[string]string{
+	"start":  "start_time",
+	"script": "script_id",
+	"state":  "state",
+	"cause":  "cause",
+	"code":   "exit_code",
+}
+
+var runStates = []State{
+	StateRunning,
+	StateDone,
+	StateNonzeroCode,
+	StateFailed,
+	StateInterrupted,
+	StateKilled,
+	StateMissed,
+	StateSkipped,
+}
+
+var runCauses = []Cause{
+	CauseManual,
+	CauseScheduled,
+	CausePeriodic,
+	CausePing,
+	CauseMissedPing,
+}
+
+type runsQuery struct {
+	query *gorm.DB
+	sort  string
+	desc  bool
+}
+
+// columns are the keyset of the query's ordering.
+func (q runsQuery) columns() []string {
+	cols := []string{"start_time", "script_id", "run_no"}
+	if q.sort != "start" {
+		cols = append([]string{runSortColumns[q.sort]}, cols...)
+	}
+	return cols
+}
+
+// sqlTime is an SQL expression for the time expr, which compares in time
+// order. SQLite keeps times as text with the offset of the zone they were
+// written in, which does not compare across offsets, like those before and
+// after a change to daylight saving time; they are compared in UTC there,
+// to the millisecond.
+func sqlTime(expr string) string {
+	if db.Dialect().GetName() == "sqlite3" {
+		return "strftime('%Y-%m-%d %H:%M:%f', " + expr + ")"
+	}
+	return expr
+}
+
+// keyExpr is the SQL expression for the column of the keyset, or for a
+// value of it if it is a placeholder.
+func keyExpr(col, expr string) string {
+	if col == "start_time" {
+		return sqlTime(expr)
+	}
+	return expr
+}
+
+func (q runsQuery) ordered() *gorm.DB {
+	dir := "asc"
+	if q.desc {
+		dir = "desc"
+	}
+	query := q.query
+	for _, col := range q.columns() {
+		query = query.Order(keyExpr(col, col) + " " + dir)
+	}
+	return query
+}
+
+// cursor encodes the position of a run in the ordering, to continue the
+// next page after it, or the previous one before it.
+func (q runsQuery) cursor(r Run) string {
+	key := []string{
+		strconv.FormatInt(r.StartTime.UnixNano(), 10),
+		strconv.Itoa(r.ScriptID),
+		strconv.Itoa(r.RunNo),
+	}
+	switch q.sort {
+	case "script":
+		key = append([]string{strconv.Itoa(r.ScriptID)}, key...)
+	case "state":
+		key = append([]string{strconv.Itoa(int(r.State))}, key...)
+	case "cause":
+		key = append([]string{strconv.Itoa(int(r.Cause))}, key...)
+	case "code":
+		key = append([]string{strconv.Itoa(r.ExitCode)}, key...)
+	}
+	return strings.Join(key, ".")
+}
+
+// page returns the query for the runs after the cursor, or, if back is
+// set, for those before it, in reverse order.
+func (q runsQuery) page(cursor string, back bool) (*gorm.DB, error) {
+	if back {
+		q.desc = !q.desc
+	}
+	cols := q.columns()
+	parts := strings.Split(cursor, ".")
+	if len(parts) != len(cols) {
+		return nil, fmt.Errorf("bad cursor %q", cursor)
+	}
+
+	args := make([]interface{}, len(parts))
+	for i, p := range parts {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad cursor %q", cursor)
+		}
+		if cols[i] == "start_time" {
+			args[i] = time.Unix(0, n)
+		} else {
+			args[i] = n
+		}
+	}
+
+	op := ">"
+	if q.desc {
+		op = "<"
+	}
+	keys := make([]string, len(cols))
+	placeholders := make([]string, len(cols))
+	for i, col := range cols {
+		keys[i] = keyExpr(col, col)
+		placeholders[i] = keyExpr(col, "?")
+	}
+	return q.ordered().Where("("+strings.Join(keys, ", ")+") "+op+" ("+strings.Join(placeholders, ", ")+")", args...), nil
+}
+
+// filterRuns builds the query for the filters and ordering in the form,
+// along with complaints about the filters it could not make sense of.
+func filterRuns(form url.Values) (runsQuery, []string) {
+	var errs []string
+	q := runsQuery{query: db.Model(&Run{}), sort: "start", desc: form.Get("dir") != "asc"}
+
+	if sort := form.Get("sort"); sort != "" {
+		if _, ok := runSortColumns[sort]; ok {
+			q.sort = sort
+		} else {
+			errs = append(errs, "Bad sort column '"+sort+"'")
+		}
+	}
+	if v := form.Get("script"); v != "" {
+		if scriptID, err := strconv.Atoi(v); err == nil {
+			q.query = q.query.Where("script_id = ?", scriptID)
+		} else {
+			errs = append(errs, "Bad script ID '"+v+"'")
+		}
+	}
+	if owner := form.Get("owner"); owner != "" {
+		q.query = q.query.Where("script_id IN (SELECT id FROM scripts WHERE owner = ?)", owner)
+	}
+	if v := form.Get("state"); v != "" {
+		found := false
+		for _, st := range runStates {
+			if stateName(st) == v {
+				q.query = q.query.Where("state = ?", int64(st))
+				found = true
+			}
+		}
+		if !found {
+			errs = append(errs, "Bad state '"+v+"'")
+		}
+	}
+	if v := form.Get("cause"); v != "" {
+		found := false
+		for _, c := range runCauses {
+			if c.String() == v {
+				q.query = q.query.Where("cause = ?", int64(c))
+				found = true
+			}
+		}
+		if !found {
+			errs = append(errs, "Bad cause '"+v+"'")
+		}
+	}
+	for _, bound := range []struct{ field, op string }{{"from", ">="}, {"to", "<="}} {
+		if v := form.Get(bound.field); v != "" {
+			t, err := parseTime(v)
+			if err != nil {
+				errs = append(errs, "Bad time '"+v+"': "+err.Error())
+				continue
+			}
+			q.query = q.query.Where(sqlTime("start_time")+" "+bound.op+" "+sqlTime("?"), t)
+		}
+	}
+
+	return q, errs
+}
+
+func listRuns(w http.ResponseWriter, r *http.Request, u user) {
+	r.ParseForm()
+	q, errs := filterRuns(r.Form)
+
+	switch format := r.Form.Get("format"); format {
+	case "csv", "json":
+		if len(errs) > 0 {
+			http.Error(w, strings.Join(errs, "\n"), 400)
+			return
+		}
+		exportRuns(w, r, q, format)
+		return
+	case "":
+	default:
+		http.Error(w, "unknown format "+format, 400)
+		return
+	}
+
+	flashMessages := getFlashMessages(w, r)
+	for _, e := range errs {
+		flashMessages = append(flashMessages, flashMessage{ID: "error", Args: []string{e}})
+	}
+
+	query := q.ordered()
+	cursor, back := r.Form.Get("after"), false
+	if before := r.Form.Get("before"); before != "" {
+		cursor, back = before, true
+	}
+	if cursor != "" {
+		var err error
+		if query, err = q.page(cursor, back); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	// one more run than shown tells if there is another page
+	var runs []Run
+	if err := query.Limit(runsPageSize + 1).Find(&runs).Error; err != nil {
+		flashMessages = append(flashMessages, flashMessage{
+			ID:   "error",
+			Args: []string{"Failed to query runs: " + err.Error()},
+		})
+	}
+	more := len(runs) > runsPageSize
+	if more {
+		runs = runs[:runsPageSize]
+	}
+	if back {
+		for i, j := 0, len(runs)-1; i < j; i, j = i+1, j-1 {
+			runs[i], runs[j] = runs[j], runs[i]
+		}
+	}
+	fillScripts(runs)
+
+	link := func(set map[string]string) string {
+		v := url.Values{}
+		for k, vs := range r.Form {
+			if k != "after" && k != "before" {
+				v[k] = vs
+			}
+		}
+		for k, s := range set {
+			v.Set(k, s)
+		}
+		return Link("/runs") + "?" + v.Encode()
+	}
+
+	// having gone back, there is the page come from after this one
+	var prev, next string
+	if len(runs) > 0 && ((back && more) || (!back && cursor != "")) {
+		prev = link(map[string]string{"before": q.cursor(runs[0])})
+	}
+	if len(runs) > 0 && ((!back && more) || back) {
+		next = link(map[string]string{"after": q.cursor(runs[len(runs)-1])})
+	}
+
+	// clicking a column header sorts by it, clicking it again reverses
+	sortLinks := make(map[string]string)
+	for key := range runSortColumns {
+		dir := "desc"
+		if key == q.sort && q.desc {
+			dir = "asc"
+		}
+		sortLinks[key] = link(map[string]string{"sort": key, "dir": dir})
+	}
+
+	var states []string
+	for _, st := range runStates {
+		states = append(states, stateName(st))
+	}
+
+	execTmpl(w, r, "runs", map[string]interface{}{
+		"user":          u,
+		"flashMessages": flashMessages,
+		"runs":          runs,
+		"filter":        r.Form,
+		"states":        states,
+		"causes":        runCauses,
+		"sort":          q.sort,
+		"desc":          q.desc,
+		"sortLinks":     sortLinks,
+		"prev":          prev,
+		"next":          next,
+		"first":         link(nil),
+		"csv":           link(map[string]string{"format": "csv"}),
+		"json":          link(map[string]string{"format": "json"}),
+	})
+}
+
+type runRecord struct {
+	ScriptID    int        `json:"script_id"`
+	Script      string     `json:"script"`
+	Owner       user       `json:"owner"`
+	RunNo       int        `json:"run_no"`
+	State       string     `json:"state"`
+	Cause       string     `json:"cause"`
+	TriggeredBy user       `json:"triggered_by,omitempty"`
+	Scheduled   *time.Time `json:"scheduled,omitempty"`
+	StartTime   time.Time  `json:"start_time"`
+	FinishTime  *time.Time `json:"finish_time,omitempty"`
+	Duration    *float64   `json:"duration_seconds,omitempty"`
+	ExitCode    *int       `json:"exit_code,omitempty"`
+	GitCommit   string     `json:"git_commit,omitempty"`
+	Params      url.Values `json:"params,omitempty"`
+}
+
+func newRunRecord(run Run) runRecord {
+	rec := runRecord{
+		ScriptID:    run.ScriptID,
+		RunNo:       run.RunNo,
+		State:       stateName(run.State),
+		Cause:       run.Cause.String(),
+		TriggeredBy: run.TriggeredBy,
+		Scheduled:   run.Scheduled,
+		StartTime:   run.StartTime,
+		FinishTime:  run.FinishTime,
+		GitCommit:   run.GitCommit,
+	}
+	if params, err := url.ParseQuery(run.Params); err == nil && len(params) > 0 {
+		rec.Params = params
+	}
+	if s, ok := allScripts.lookup(run.ScriptID); ok {
+		rec.Script = s.Name
+		rec.Owner = s.Owner
+	}
+	if run.FinishTime != nil {
+		d := run.Duration().Seconds()
+		rec.Duration = &d
+		code := run.ExitCode
+		rec.ExitCode = &code
+	}
+	return rec
+}
+
+func optionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// exportRuns writes all runs matching the query, not just a page of them.
+func exportRuns(w http.ResponseWriter, r *http.Request, q runsQuery, format string) {
+	rows, err := q.ordered().Rows()
+	if err != nil {
+		reqLog(r).Error("failed to query runs", "err", err)
+		http.Error(w, "failed to query runs", 500)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Disposition", "attachment; filename=runs."+format)
+
+	var cw *csv.Writer
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw = csv.NewWriter(w)
+		cw.Write([]string{"script_id", "script", "owner", "run_no", "state", "cause", "triggered_by",
+			"scheduled", "start_time", "finish_time", "duration_seconds", "exit_code", "git_commit", "params"})
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("["))
+	}
+
+	n := 0
+	for rows.Next() {
+		var run Run
+		if err := db.ScanRows(rows, &run); err != nil {
+			reqLog(r).Error("failed to read run", "err", err)
+			break
+		}
+		rec := newRunRecord(run)
+
+		if cw != nil {
+			var duration, code string
+			if rec.Duration != nil {
+				duration = strconv.FormatFloat(*rec.Duration, 'f', 3, 64)
+				code = strconv.Itoa(*rec.ExitCode)
+			}
+			cw.Write([]string{strconv.Itoa(rec.ScriptID), rec.Script, string(rec.Owner), strconv.Itoa(rec.RunNo),
+				rec.State, rec.Cause, string(rec.TriggeredBy), optionalTime(rec.Scheduled),
+				rec.StartTime.Format(time.RFC3339Nano), optionalTime(rec.FinishTime), duration, code, rec.GitCommit, run.Params})
+			continue
+		}
+
+		b, err := json.Marshal(rec)
+		if err != nil {
+			reqLog(r).Error("failed to encode run", "err", err)
+			break
+		}
+		if n > 0 {
+			w.Write([]byte(",\n"))
+		}
+		w.Write(b)
+		n++
+	}
+
+	if cw != nil {
+		cw.Flush()
+	} else {
+		w.Write([]byte("]\n"))
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// runKeys lists the runs the query finds, page by page, continuing every
+// page after the cursor of the last run of the page before. Going back, it
+// starts after the last run and continues before the first run of the page
+// before, and lists the runs in reverse.
+func runKeys(t *testing.T, form url.Values, pageSize int, back bool) []string {
+	q, errs := filterRuns(form)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	var keys []string
+	query := q.ordered()
+	if back {
+		var all []Run
+		if err := q.ordered().Find(&all).Error; err != nil || len(all) == 0 {
+			t.Fatal(all, err)
+		}
+		last := all[len(all)-1]
+		keys = append(keys, fmt.Sprintf("%d/%d", last.ScriptID, last.RunNo))
+		var err error
+		if query, err = q.page(q.cursor(last), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		var runs []Run
+		if err := query.Limit(pageSize).Find(&runs).Error; err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range runs {
+			keys = append(keys, fmt.Sprintf("%d/%d", r.ScriptID, r.RunNo))
+		}
+		if len(runs) < pageSize {
+			return keys
+		}
+		if len(keys) > 1000 {
+			t.Fatal("pages do not end")
+		}
+		var err error
+		if query, err = q.page(q.cursor(runs[len(runs)-1]), back); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func reversed(keys []string) []string {
+	var ret []string
+	for i := len(keys) - 1; i >= 0; i-- {
+		ret = append(ret, keys[i])
+	}
+	return ret
+}
+
+func TestRunsPagination(t *testing.T) {
+	testDB(t)
+
+	start := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	states := []State{StateDone, StateFailed, StateNonzeroCode}
+	causes := []Cause{CauseManual, CausePeriodic}
+	for i := 0; i < 20; i++ {
+		run := Run{
+			ScriptID: 1 + i%3,
+			RunNo:    1 + i,
+			// runs share start times, which the cursor has to tell apart
+			StartTime: start.Add(time.Duration(i/4) * time.Minute),
+			State:     states[i%len(states)],
+			Cause:     causes[i%len(causes)],
+			ExitCode:  i % 4,
+		}
+		if err := db.Create(&run).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for sort := range runSortColumns {
+		for _, dir := range []string{"asc", "desc"} {
+			form := url.Values{"sort": {sort}, "dir": {dir}}
+			all := runKeys(t, form, 100, false)
+			if len(all) != 20 {
+				t.Fatalf("%s %s: %d runs", sort, dir, len(all))
+			}
+			for _, pageSize := range []int{1, 3, 7} {
+				paged := runKeys(t, form, pageSize, false)
+				if fmt.Sprint(paged) != fmt.Sprint(all) {
+					t.Errorf("%s %s by %d: %v, want %v", sort, dir, pageSize, paged, all)
+				}
+				paged = reversed(runKeys(t, form, pageSize, true))
+				if fmt.Sprint(paged) != fmt.Sprint(all) {
+					t.Errorf("%s %s by %d backwards: %v, want %v", sort, dir, pageSize, paged, all)
+				}
+			}
+		}
+	}
+
+	// filters apply to the following pages as well
+	paged := runKeys(t, url.Values{"script": {"2"}, "dir": {"asc"}}, 2, false)
+	if fmt.Sprint(paged) != "[2/2 2/5 2/8 2/11 2/14 2/17 2/20]" {
+		t.Errorf("filtered: %v", paged)
+	}
+
+	q, _ := filterRuns(url.Values{})
+	for _, cursor := range []string{"", "1.2", "a.b.c", "1.2.3.4"} {
+		if _, err := q.page(cursor, false); err == nil {
+			t.Errorf("bad cursor %q accepted", cursor)
+		}
+	}
+}
+
+func TestRunsPaginationAcrossOffsets(t *testing.T) {
+	testDB(t)
+
+	// runs every 20 minutes over the end of daylight saving time, with the
+	// offsets of the time they started
+	edt, est := time.FixedZone("EDT", -4*3600), time.FixedZone("EST", -5*3600)
+	end := time.Date(2026, 11, 1, 6, 0, 0, 0, time.UTC)
+	var want []string
+	for i := 0; i < 9; i++ {
+		start := end.Add(time.Duration(i-4) * 20 * time.Minute)
+		if start.Before(end) {
+			start = start.In(edt)
+		} else {
+			start = start.In(est)
+		}
+		if err := db.Create(&Run{ScriptID: 1, RunNo: i + 1, StartTime: start}).Error; err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, fmt.Sprintf("1/%d", i+1))
+	}
+
+	for _, pageSize := range []int{2, 100} {
+		paged := runKeys(t, url.Values{"dir": {"asc"}}, pageSize, false)
+		if fmt.Sprint(paged) != fmt.Sprint(want) {
+			t.Errorf("by %d: %v, want %v", pageSize, paged, want)
+		}
+	}
+	// the hour before the change, as given in the other offset
+	paged := runKeys(t, url.Values{"dir": {"asc"}, "from": {"2026-11-01T05:00:00Z"}, "to": {"2026-11-01T05:40:00Z"}}, 100, false)
+	if fmt.Sprint(paged) != "[1/2 1/3 1/4]" {
+		t.Errorf("filtered by time: %v", paged)
+	}
+}
@@ -1,19 +1,24 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql/driver"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 )
 
@@ -24,25 +29,58 @@ type Script struct {
 	RunCounter int
 
 	Name                        string `param:"string"`
+	Kind                        string `param:"string"`
 	RunPeriod                   string `param:"string"`
 	PeriodicRunsEnabled         bool   `param:"bool"`
 	ScheduledRunsEnabled        bool   `param:"bool"`
 	AutomaticRunsDisableOnError bool   `param:"bool"`
-
-	EmailNotification bool   `param:"bool"`
-	EmailAddress      string `param:"string"`
+	MisfirePolicy               string `param:"string"`
+	MisfireThreshold            string `param:"string"`
+
+	NotifyOnFailure     bool   `param:"bool"`
+	NotifyOnRecovery    bool   `param:"bool"`
+	NotifyOnEveryRun    bool   `param:"bool"`
+	NotifyAfterFailures int    `param:"int"`
+	NotifyQuietPeriod   string `param:"string"`
+	EmailAddress        string `param:"string"`
+
+	WebhookURL    string `param:"string"`
+	WebhookFormat string `param:"string"`
+	WebhookSecret string `param:"string"`
+
+	HeartbeatPeriod string `param:"string"`
+	HeartbeatGrace  string `param:"string"`
+	PingToken       string
+
+	// GitPath is set on scripts defined in the git repository, and is the
+	// directory of the script within it. GitCommit is the commit the
+	// definition was last taken from.
+	GitPath   string
+	GitCommit string
+	// GitOrphaned is set on scripts whose definition went missing from the
+	// repository. They are kept, without automatic runs, until it comes
+	// back or they are deleted.
+	GitOrphaned bool
 
 	Scheduled *time.Time
 
-	started       bool           `gorm:"-"`
-	stopch        chan struct{}  `gorm:"-"`
-	manualch      chan struct{}  `gorm:"-"`
-	quitch        chan struct{}  `gorm:"-"`
-	killch        chan os.Signal `gorm:"-"`
-	updateschedch chan struct{}  `gorm:"-"`
+	FailureStreak int
+	LastNotified  *time.Time
+
+	started       bool             `gorm:"-"`
+	stopch        chan struct{}    `gorm:"-"`
+	manualch      chan trigger     `gorm:"-"`
+	quitch        chan struct{}    `gorm:"-"`
+	killch        chan killRequest `gorm:"-"`
+	updateschedch chan struct{}    `gorm:"-"`
+	pingch        chan ping        `gorm:"-"`
 
 	changechM sync.Mutex
 	changech  chan struct{} `gorm:"-"`
+
+	// resumeRuns are runs left running by the previous runtriggers
+	// process, for the loop to pick up first
+	resumeRuns []Run `gorm:"-"`
 }
 
 func (s *Script) Copy() Script {
@@ -55,6 +93,8 @@ func (s *Script) Copy() Script {
 	copy.quitch = nil
 	copy.killch = nil
 	copy.updateschedch = nil
+	copy.pingch = nil
+	copy.resumeRuns = nil
 
 	return copy
 }
@@ -66,6 +106,8 @@ const (
 	CauseManual
 	CauseScheduled
 	CausePeriodic
+	CausePing
+	CauseMissedPing
 
 /*	CauseFilesystem
 	CauseExternal */
@@ -81,6 +123,10 @@ func (c Cause) String() string {
 		return "scheduled"
 	case CausePeriodic:
 		return "periodic"
+	case CausePing:
+		return "ping"
+	case CauseMissedPing:
+		return "missed-ping"
 		/*
 			case CauseFilesystem:
 				return "filesystem"
@@ -114,6 +160,8 @@ const (
 	StateKilled
 	StateDone
 	StateNonzeroCode
+	StateMissed
+	StateSkipped
 )
 
 func (s State) String() string {
@@ -130,6 +178,10 @@ func (s State) String() string {
 		return ""
 	case StateNonzeroCode:
 		return "non-zero code"
+	case StateMissed:
+		return "missed"
+	case StateSkipped:
+		return "skipped"
 	default:
 		return "<invalid state>"
 	}
@@ -163,13 +215,35 @@ type Run struct {
 
 	LogFilename string
 
-	Cause Cause
+	Cause       Cause
+	TriggeredBy user
+
+	// GitCommit is the commit the script's definition came from, for
+	// scripts defined in git.
+	GitCommit string
+
+	// Params are the parameters of a manual run, URL-encoded. They are
+	// passed to the script as environment variables.
+	Params string
 
 	ScriptID int `gorm:"primary_key;auto_increment:false"`
 	RunNo    int `gorm:"primary_key;auto_increment:false"`
 	Script   *Script
 }
 
+// Lateness is how long after its planned time the run started.
+func (r Run) Lateness() time.Duration {
+	if r.Scheduled == nil {
+		return 0
+	}
+	return r.StartTime.Sub(*r.Scheduled)
+}
+
+// Late tells if the run started noticeably after its planned time.
+func (r Run) Late() bool {
+	return r.Lateness() >= time.Second
+}
+
 func (r Run) Duration() time.Duration {
 	if r.FinishTime != nil {
 		return r.FinishTime.Sub(r.StartTime)
@@ -178,20 +252,62 @@ func (r Run) Duration() time.Duration {
 	}
 }
 
+// Outcome describes how the run ended, for use in notifications.
+func (r Run) Outcome() string {
+	switch r.State {
+	case StateRunning:
+		return "is still running"
+	case StateFailed:
+		return "failed to start"
+	case StateInterrupted:
+		return "has been interrupted"
+	case StateKilled:
+		return "has been killed"
+	case StateDone:
+		return "finished successfully"
+	case StateNonzeroCode:
+		return fmt.Sprintf("exited with non-zero exit code %d", r.ExitCode)
+	case StateMissed:
+		return "has not been pinged in time"
+	case StateSkipped:
+		return "has been skipped"
+	default:
+		return "ended in an unknown state"
+	}
+}
+
 func (s *Script) loop() {
+	for _, run := range s.resumeRuns {
+		s.resume(run)
+	}
+	s.resumeRuns = nil
+
 loop:
 	for {
 		var cause Cause
+		var t trigger
+		var p ping
+		var planned *time.Time
+		var period time.Duration
 	wait:
 		for {
+			if shuttingDown() {
+				break loop
+			}
 			if err := db.First(s, s.ID).Error; err != nil {
-				log.Printf("failed to re-read script: %s", err)
+				s.logger().Error("failed to re-read script", "err", err)
 			}
 
 			var schedulech <-chan time.Time
 			var periodch <-chan time.Time
+			var heartbeatch <-chan time.Time
+			var nextPeriodic *time.Time
 
-			if s.ScheduledRunsEnabled && s.Scheduled != nil {
+			if s.Kind == KindHeartbeat {
+				if deadline, ok := s.heartbeatDeadline(); ok && !s.GitOrphaned {
+					heartbeatch = time.After(deadline.Sub(time.Now()))
+				}
+			} else if s.ScheduledRunsEnabled && s.Scheduled != nil {
 				duration := s.Scheduled.Sub(time.Now())
 				if duration < 0 {
 					duration = 0
@@ -199,26 +315,33 @@ loop:
 				schedulech = time.After(duration)
 			}
 
-			if s.PeriodicRunsEnabled {
+			if s.PeriodicRunsEnabled && s.Kind != KindHeartbeat {
 				var err error
-				var period time.Duration
 				var lastRunTime time.Time
 				if period, err = time.ParseDuration(s.RunPeriod); err != nil {
-					log.Printf("%q: failed to parse period %q", s.Name, s.RunPeriod)
+					s.logger().Error("failed to parse period", "period", s.RunPeriod, "err", err)
 					period = 356 * 24 * time.Hour
 				}
 				if s.RunCounter == 0 {
-					period = 0 /* no last run, cause an immediate run */
+					/* no last run, cause an immediate run */
+					periodch = time.After(0)
 				} else {
 					var lastRun Run
 					if err = db.Where("script_id=? AND run_no=?", s.ID, s.RunCounter).First(&lastRun).Error; err == nil {
+						// count from the planned start of the last run,
+						// so that runs caught up on do not shift the schedule
 						lastRunTime = lastRun.StartTime
+						if lastRun.Scheduled != nil {
+							lastRunTime = *lastRun.Scheduled
+						}
 					} else {
-						log.Printf("failed to find last run: %s", err.Error())
+						s.logger().Error("failed to find last run", "run_no", s.RunCounter, "err", err)
 						lastRunTime = time.Now()
 					}
+					next := lastRunTime.Add(period)
+					nextPeriodic = &next
+					periodch = time.After(next.Sub(time.Now()))
 				}
-				periodch = time.After(lastRunTime.Add(period).Sub(time.Now()))
 			}
 
 			select {
@@ -226,19 +349,41 @@ loop:
 				/* no-op */
 			case <-s.stopch:
 				break loop
-			case <-s.manualch:
+			case <-shutdownch:
+				break loop
+			case t = <-s.manualch:
 				cause = CauseManual
 				break wait
 			case <-schedulech:
 				cause = CauseScheduled
+				planned = s.Scheduled
 				break wait
 			case <-periodch:
 				cause = CausePeriodic
+				planned = nextPeriodic
+				break wait
+			case p = <-s.pingch:
+				cause = CausePing
+				break wait
+			case <-heartbeatch:
+				cause = CauseMissedPing
 				break wait
 			}
 		}
 
-		s.run(cause)
+		// a trigger may have been chosen over the shutdown
+		if shuttingDown() {
+			break loop
+		}
+
+		switch {
+		case cause == CausePing || cause == CauseMissedPing:
+			s.heartbeat(cause, p)
+		case planned != nil:
+			s.misfire(cause, *planned, period)
+		default:
+			s.run(cause, t, nil)
+		}
 	}
 
 	close(s.quitch)
@@ -270,7 +415,7 @@ func logFilename(run Run) string {
 
 func (s *Script) schedule(nextRun time.Time) {
 	if err := db.Model(s).Update("Scheduled", nextRun).Error; err != nil {
-		log.Printf("failed to reschedule: %s", err)
+		s.logger().Error("failed to reschedule", "err", err)
 	}
 	// signal to the script's loop to re-read the script from DB
 	select {
@@ -281,7 +426,7 @@ func (s *Script) schedule(nextRun time.Time) {
 
 func (s *Script) unschedule() {
 	if err := db.Model(s).Update("Scheduled", nil).Error; err != nil {
-		log.Printf("failed to reschedule: %s", err)
+		s.logger().Error("failed to unschedule", "err", err)
 	}
 	select {
 	case s.updateschedch <- struct{}{}:
@@ -289,27 +434,52 @@ func (s *Script) unschedule() {
 	}
 }
 
-func (s *Script) run(cause Cause) {
+// trigger is who asked for a manual run and with which parameters. The
+// number of the run is sent to started once the run is recorded, or 0 if it
+// could not be.
+type trigger struct {
+	by      user
+	params  url.Values
+	started chan int
+}
+
+func (t trigger) notify(runNo int) {
+	if t.started != nil {
+		t.started <- runNo
+	}
+}
+
+// run runs the script. planned is the time the run was due at, nil for
+// manual runs.
+func (s *Script) run(cause Cause, t trigger, planned *time.Time) {
 	var run Run
 	var err error
 	run.StartTime = time.Now()
+	run.Scheduled = planned
 	run.Script = s
 	run.Cause = cause
+	run.TriggeredBy = t.by
+	run.GitCommit = s.GitCommit
+	run.Params = t.params.Encode()
 	s.RunCounter += 1
 	run.RunNo = s.RunCounter
 	run.LogFilename = logFilename(run)
 	run.State = StateRunning
+	l := s.logger().With("run_no", run.RunNo)
 
 	// update the script's run counter first
 	if err = db.Save(s).Error; err != nil {
-		log.Printf("failed to save script: %s", err)
+		l.Error("failed to save script", "err", err)
+		t.notify(0)
 		return
 	}
 
 	if err = db.Create(&run).Error; err != nil {
-		log.Printf("failed to create run: %s", err)
+		l.Error("failed to create run", "err", err)
+		t.notify(0)
 		return
 	}
+	t.notify(run.RunNo)
 
 	s.broadcastChange()
 	defer s.broadcastChange()
@@ -318,52 +488,45 @@ func (s *Script) run(cause Cause) {
 		// clear the scheduled time
 		s.Scheduled = nil
 		if err = db.Save(s).Error; err != nil {
-			log.Printf("failed to save script: %s", err)
+			l.Error("failed to save script", "err", err)
 			return
 		}
 	}
 
+	metricRunning.Inc()
+	defer metricRunning.Dec()
+	detached := false
 	defer func() {
-		now := time.Now()
-		run.FinishTime = &now
-		if run.State == StateRunning {
-			run.State = StateDone
-		}
-
-		scriptChange := false
-
-		if run.State != StateDone && s.EmailNotification {
-			go notifyAnomalous(*s, run)
-			s.EmailNotification = false
-			scriptChange = true
-		}
-
-		if run.State != StateDone && s.AutomaticRunsDisableOnError {
-			s.ScheduledRunsEnabled = false
-			s.PeriodicRunsEnabled = false
-			scriptChange = true
-		}
-
-		if scriptChange {
-			if err = db.Save(s).Error; err != nil {
-				log.Printf("failed to save script: %s", err)
-			}
-		}
-
-		if err = db.Save(&run).Error; err != nil {
-			log.Printf("failed to save run: %s", err)
+		if !detached {
+			s.finish(&run)
 		}
 	}()
 
 	os.MkdirAll(filepath.Dir(run.LogFilename), 0755)
 	f, err := os.Create(run.LogFilename)
 	if err != nil {
-		log.Printf("failed to create log file: %s", err)
+		l.Error("failed to create log file", "path", run.LogFilename, "err", err)
 		run.State = StateFailed
 		return
 	}
 	defer f.Close()
 
+	if late := run.Lateness(); planned != nil && late >= s.misfireThreshold() {
+		fmt.Fprintf(f, "runtriggers: run planned for %s started %s late\n",
+			planned.Format(time.RFC3339), FormatDuration(late))
+	}
+
+	env, err := paramEnv(t.params)
+	if err != nil {
+		fmt.Fprintf(f, "runtriggers: %s\n", err)
+		run.State = StateFailed
+		return
+	}
+	for _, v := range env {
+		name, value, _ := strings.Cut(strings.TrimPrefix(v, paramEnvPrefix), "=")
+		fmt.Fprintf(f, "runtriggers: parameter %s=%q\n", name, value)
+	}
+
 	argv := parseShebang(s.Text)
 	if argv == nil {
 		argv = []string{"/bin/sh"}
@@ -376,44 +539,204 @@ func (s *Script) run(cause Cause) {
 		return
 	}
 	trueArgv := append([]string{suExec, string(s.Owner)}, argv...)
-	cmd := exec.Cmd{
-		Path:   trueArgv[0],
-		Args:   trueArgv,
-		Stdin:  bytes.NewBufferString(s.Text),
-		Stderr: f,
-		Stdout: f,
-	}
 
-	if err = cmd.Start(); err != nil {
+	proc, exited, err := startSupervised(run, trueArgv, env, s.Text, f)
+	if err != nil {
 		fmt.Fprintf(f, "runtriggers: process run failed: %s\n", err)
 		run.State = StateFailed
 		return
 	}
+	detached = !s.await(&run, f, proc.Pid, exited)
+}
 
-	waitch := make(chan struct{})
-	go func() {
-		cmd.Wait()
-		close(waitch)
-	}()
+// paramEnvPrefix namespaces run parameters in the environment of scripts,
+// so that they cannot set variables like PATH or LD_PRELOAD.
+const paramEnvPrefix = "RT_PARAM_"
+
+// paramName restricts run parameters to names usable in environment
+// variables.
+var paramName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// paramEnv returns the environment variables passing the parameters to a
+// script, sorted by name.
+func paramEnv(params url.Values) ([]string, error) {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		if !paramName.MatchString(name) {
+			return nil, fmt.Errorf("bad parameter name %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	env := make([]string, 0, len(names))
+	for _, name := range names {
+		env = append(env, paramEnvPrefix+name+"="+params.Get(name))
+	}
+	return env, nil
+}
+
+// resume picks up a run left running by an earlier runtriggers process,
+// whose supervisor may still be running or may have finished meanwhile.
+func (s *Script) resume(run Run) {
+	run.Script = s
+	l := s.logger().With("run_no", run.RunNo)
+
+	status, err := readRunStatus(run)
+	if err != nil || !(status.Finished != nil || supervising(status.Pid, run)) {
+		l.Warn("run was interrupted")
+		os.Remove(statusFilename(run))
+		run.State = StateInterrupted
+		s.finish(&run)
+		return
+	}
+
+	f, err := os.OpenFile(run.LogFilename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		l.Error("failed to open log file", "path", run.LogFilename, "err", err)
+		f = devNull
+	} else {
+		defer f.Close()
+		fmt.Fprintf(f, "runtriggers: resumed the run after a restart\n")
+	}
+
+	l.Info("resuming run", "pid", status.Pid)
+	s.broadcastChange()
+	defer s.broadcastChange()
+	metricRunning.Inc()
+	defer metricRunning.Dec()
+	if s.await(&run, f, status.Pid, nil) {
+		s.finish(&run)
+	}
+}
+
+// await waits for the supervisor of the run to exit, passing on signals
+// meanwhile, and sets the outcome of the run from its status. exited is
+// closed when the supervisor exits, or nil if it is not a child of this
+// process. It returns false if runtriggers shuts down leaving the run to
+// the supervisor.
+func (s *Script) await(run *Run, f *os.File, pid int, exited <-chan struct{}) bool {
+	var poll <-chan time.Time
+	if exited == nil {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	var detach <-chan struct{}
+	if *flagShutdownMode == ShutdownDetach {
+		detach = shutdownch
+	}
 
 waitloop:
 	for {
 		select {
-		case signal := <-s.killch:
-			cmd.Process.Signal(signal)
+		case req := <-s.killch:
+			signalSupervisor(pid, req.signal.(syscall.Signal))
 			run.State = StateKilled
-			fmt.Fprintf(f, "runtriggers: sending signal %d\n", signal)
-		case <-waitch:
+			fmt.Fprintf(f, "runtriggers: sending signal %d\n", req.signal)
+			req.killed <- run.RunNo
+		case <-exited:
 			break waitloop
+		case <-poll:
+			if !supervising(pid, *run) {
+				break waitloop
+			}
+		case <-detach:
+			fmt.Fprintf(f, "runtriggers: detached from the run on shutdown\n")
+			return false
 		}
 	}
 
-	code := cmd.ProcessState.ExitCode()
-	run.ExitCode = code
-	if code != 0 && run.State == StateRunning {
-		run.State = StateNonzeroCode
+	status, err := readRunStatus(*run)
+	switch {
+	case err == nil && status.Error != "":
+		fmt.Fprintf(f, "runtriggers: process run failed: %s\n", status.Error)
+		run.State = StateFailed
+	case err == nil && status.ExitCode != nil:
+		run.ExitCode = *status.ExitCode
+		run.FinishTime = status.Finished
+		if run.ExitCode != 0 && run.State == StateRunning {
+			run.State = StateNonzeroCode
+		}
+		fmt.Fprintf(f, "runtriggers: '%s' exited with code %d\n", status.Command, run.ExitCode)
+	default:
+		fmt.Fprintf(f, "runtriggers: the run's supervisor exited without a status\n")
+		run.State = StateInterrupted
 	}
-	fmt.Fprintf(f, "runtriggers: '%s' exited with code %d\n", argv[0], code)
+	os.Remove(statusFilename(*run))
+	return true
+}
+
+// finish records the end of a run and notifies about it.
+func (s *Script) finish(run *Run) {
+	l := s.logger().With("run_no", run.RunNo)
+	now := time.Now()
+	if run.FinishTime == nil && run.State != StateInterrupted {
+		run.FinishTime = &now
+	}
+	if run.State == StateRunning {
+		run.State = StateDone
+	}
+
+	observeRun(s, *run)
+	metricRunDuration.With(scriptLabels(s)).Observe(run.Duration().Seconds())
+
+	failures := s.FailureStreak
+	if event, ok := s.notificationFor(*run, now); ok {
+		notify(event, *s, *run, failures)
+	}
+
+	if run.State != StateDone && s.AutomaticRunsDisableOnError {
+		s.ScheduledRunsEnabled = false
+		s.PeriodicRunsEnabled = false
+	}
+
+	if err := db.Save(s).Error; err != nil {
+		l.Error("failed to save script", "err", err)
+	}
+
+	if err := db.Save(run).Error; err != nil {
+		l.Error("failed to save run", "err", err)
+	}
+}
+
+// record saves a run which involves no process, such as a ping or a
+// skipped run, with the message as its log.
+func (s *Script) record(run Run, message string) {
+	now := time.Now()
+	run.StartTime = now
+	run.FinishTime = &now
+	run.Script = s
+	run.GitCommit = s.GitCommit
+	s.RunCounter += 1
+	run.RunNo = s.RunCounter
+	run.LogFilename = logFilename(run)
+	l := s.logger().With("run_no", run.RunNo)
+
+	os.MkdirAll(filepath.Dir(run.LogFilename), 0755)
+	f, err := os.OpenFile(run.LogFilename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		l.Error("failed to create log file", "path", run.LogFilename, "err", err)
+	} else {
+		f.WriteString(message)
+		f.Close()
+	}
+
+	if run.State != StateSkipped {
+		failures := s.FailureStreak
+		if event, ok := s.notificationFor(run, now); ok {
+			notify(event, *s, run, failures)
+		}
+	}
+
+	if err = db.Save(s).Error; err != nil {
+		l.Error("failed to save script", "err", err)
+		return
+	}
+	if err = db.Create(&run).Error; err != nil {
+		l.Error("failed to create run", "err", err)
+	}
+	observeRun(s, run)
+	s.broadcastChange()
 }
 
 func (s *Script) broadcastChange() {
@@ -431,16 +754,17 @@ func (s *Script) getChangech() chan struct{} {
 
 func (s *Script) start() {
 	if s.started {
-		log.Printf("BUG: script started twice")
+		s.logger().Error("BUG: script started twice")
 		return
 	}
 
 	s.started = true
 	s.stopch = make(chan struct{})
 	s.quitch = make(chan struct{})
-	s.killch = make(chan os.Signal)
-	s.manualch = make(chan struct{}, 1)
+	s.killch = make(chan killRequest)
+	s.manualch = make(chan trigger, 1)
 	s.updateschedch = make(chan struct{}, 1)
+	s.pingch = make(chan ping, 1)
 	s.changech = make(chan struct{})
 
 	go s.loop()
@@ -458,22 +782,42 @@ func (s *Script) stop() error {
 	return nil
 }
 
-func (s *Script) kill(sig os.Signal) error {
+// killRequest asks the run in progress to pass on a signal. The run
+// answers with its number.
+type killRequest struct {
+	signal os.Signal
+	killed chan int
+}
+
+// kill signals the run in progress and returns its number.
+func (s *Script) kill(sig os.Signal) (int, error) {
+	req := killRequest{signal: sig, killed: make(chan int, 1)}
 	select {
-	case s.killch <- sig:
+	case s.killch <- req:
 	default:
-		return errors.New("script not running")
+		return 0, errors.New("script not running")
 	}
 
-	return nil
+	return <-req.killed, nil
 }
 
-func (s *Script) manual() error {
+// manual triggers a run with the given parameters. The run starts right
+// away unless the script is running, then it is queued. The returned
+// channel receives the run's number once it started.
+func (s *Script) manual(by user, params url.Values) (<-chan int, error) {
+	if s.Kind == KindHeartbeat {
+		return nil, errors.New("heartbeat scripts have nothing to run")
+	}
+	if shuttingDown() {
+		return nil, errors.New("runtriggers is shutting down")
+	}
+
+	t := trigger{by: by, params: params, started: make(chan int, 1)}
 	select {
-	case s.manualch <- struct{}{}:
-		return nil
+	case s.manualch <- t:
+		return t.started, nil
 	default:
-		return errors.New("script busy")
+		return nil, errors.New("script busy")
 	}
 }
 
@@ -545,61 +889,68 @@ func (list scriptList) delete(id int) error {
 		return err
 	}
 	delete(list.scripts, id)
+	forgetScript(script)
 	return nil
 }
 
-func initDatabase() {
+func openDatabase() {
+	if *flagDBDriver != "sqlite3" && *flagDBDriver != "postgres" {
+		fatal("unsupported database driver", "driver", *flagDBDriver)
+	}
+
 	var err error
-	db, err = gorm.Open("sqlite3", *flagDatabase)
+	db, err = gorm.Open(*flagDBDriver, *flagDatabase)
 	if err != nil {
-		panic("failed to connect database")
-	}
-
-	db.AutoMigrate(&Script{})
-	db.AutoMigrate(&Run{})
-
-	db.Exec(
-		"UPDATE scripts SET scheduled_runs_enabled=false, periodic_runs_enabled=false "+
-			"WHERE id IN ("+
-			"SELECT id FROM scripts LEFT JOIN runs WHERE runs.script_id=scripts.id "+
-			"AND scripts.run_counter=runs.run_no AND runs.state=? "+
-			"AND scripts.automatic_runs_disable_on_error "+
-			")",
-		int64(StateRunning),
-	)
-
-	var interrupted []Run
-	if err := db.Where("state=?", int64(StateRunning)).Find(&interrupted).Error; err != nil {
-		log.Printf("failed to list stale runs: %s", err)
-	}
-	for _, run := range interrupted {
-		run.Script = &Script{}
-		if err := db.Where("id=?", run.ScriptID).First(run.Script).Error; err != nil {
-			log.Printf("failed to load script: %s", err)
-		}
-		if run.Script.EmailNotification {
-			run.Script.EmailNotification = false
-			if err := db.Save(run.Script).Error; err != nil {
-				log.Printf("failed to save script: %s", err)
-			} else {
-				go notifyInterrupted(*run.Script)
-			}
-		}
+		fatal("failed to connect database", "driver", *flagDBDriver, "err", err)
 	}
+	db.SetLogger(gormLogger{})
+	db.LogMode(slog.Default().Enabled(context.Background(), slog.LevelDebug))
+}
+
+func initDatabase() {
+	openDatabase()
 
-	db.Exec(
-		"UPDATE runs SET state=? WHERE state=?",
-		int64(StateInterrupted), int64(StateRunning),
-	)
+	current, err := schemaVersionOf(db)
+	if err != nil {
+		fatal("failed to read schema version", "err", err)
+	}
+	if current > len(migrations) {
+		fatal("database schema is newer than this version of runtriggers supports, refusing to start",
+			"schema_version", current, "supported", len(migrations))
+	}
+	if err := migrateTo(db, len(migrations)); err != nil {
+		fatal("failed to migrate database", "err", err)
+	}
 
 	var scripts []Script
 	if err := db.Find(&scripts).Error; err != nil {
-		log.Fatalf("failed to load scripts: %s", err)
+		fatal("failed to load scripts", "err", err)
+	}
+
+	// runs which were going when runtriggers stopped are resumed if their
+	// supervisor still runs or recorded how they ended, and found
+	// interrupted otherwise
+	var running []Run
+	if err := db.Where("state=?", int64(StateRunning)).Order("run_no").Find(&running).Error; err != nil {
+		slog.Error("failed to list stale runs", "err", err)
+	}
+	resumeRuns := make(map[int][]Run)
+	for _, run := range running {
+		resumeRuns[run.ScriptID] = append(resumeRuns[run.ScriptID], run)
 	}
 
 	for i, _ := range scripts {
 		script := scripts[i]
+		script.resumeRuns = resumeRuns[script.ID]
+		delete(resumeRuns, script.ID)
 		allScripts.scripts[script.ID] = &script
 		script.start()
 	}
+
+	for scriptID := range resumeRuns {
+		db.Exec(
+			"UPDATE runs SET state=? WHERE state=? AND script_id=?",
+			int64(StateInterrupted), int64(StateRunning), scriptID,
+		)
+	}
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParamEnvNamespaced(t *testing.T) {
+	params := url.Values{
+		"LD_PRELOAD": {"/tmp/x.so"},
+		"PATH":       {"/tmp"},
+		"TARGET":     {"/srv"},
+	}
+	env, err := paramEnv(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"RT_PARAM_LD_PRELOAD=/tmp/x.so",
+		"RT_PARAM_PATH=/tmp",
+		"RT_PARAM_TARGET=/srv",
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("got %q, want %q", env, want)
+	}
+	for _, v := range env {
+		if strings.HasPrefix(v, "LD_PRELOAD=") || strings.HasPrefix(v, "PATH=") {
+			t.Errorf("parameter escaped its namespace: %q", v)
+		}
+	}
+}
+
+func TestParamEnvRejectsBadNames(t *testing.T) {
+	for _, name := range []string{"", "1X", "A-B", "X=Y", "A B"} {
+		if _, err := paramEnv(url.Values{name: {"v"}}); err == nil {
+			t.Errorf("name %q accepted", name)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	flagShutdownMode    = flag.String("shutdown-mode", "detach", "what to do with running scripts on SIGTERM or SIGINT: detach (leave them running, to be resumed on the next start), wait (for them to finish, up to -shutdown-timeout), signal (forward the signal to them) or drain (wait for them to finish, however long it takes)")
+	flagShutdownTimeout = flag.Duration("shutdown-timeout", time.Minute, "how long to wait for running scripts on shutdown before killing them, in the wait and signal modes, and for notifications still being sent")
+)
+
+const (
+	ShutdownDetach = "detach"
+	ShutdownWait   = "wait"
+	ShutdownSignal = "signal"
+	ShutdownDrain  = "drain"
+)
+
+var shutdownModes = []string{ShutdownDetach, ShutdownWait, ShutdownSignal, ShutdownDrain}
+
+// shutdownch is closed when runtriggers starts shutting down. From then on,
+// scripts start no new runs and their loops end once no run is going.
+var shutdownch = make(chan struct{})
+
+func shuttingDown() bool {
+	select {
+	case <-shutdownch:
+		return true
+	default:
+		return false
+	}
+}
+
+func initShutdown() {
+	if !containsString(shutdownModes, *flagShutdownMode) {
+		fatal("unknown shutdown mode", "mode", *flagShutdownMode)
+	}
+}
+
+// shutdownOnSignal waits for SIGTERM or SIGINT and shuts down: it stops
+// triggering runs, deals with the running ones as -shutdown-mode says, and
+// then stops the HTTP server. Unless detached, runs still going when the
+// wait is over, or when a second signal comes, are killed, so that every
+// run is recorded with how it ended.
+func shutdownOnSignal(srv *http.Server) {
+	sigch := make(chan os.Signal, 2)
+	signal.Notify(sigch, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigch
+	slog.Info("shutting down", "signal", sig.String(), "mode", *flagShutdownMode)
+	close(shutdownch)
+
+	scripts := allScripts.get()
+	var deadline <-chan time.Time
+	if *flagShutdownMode != ShutdownDrain {
+		deadline = time.After(*flagShutdownTimeout)
+	}
+	if *flagShutdownMode == ShutdownSignal {
+		signalRuns(scripts, sig)
+	}
+
+	if !waitForScripts(scripts, deadline, sigch) {
+		slog.Warn("killing runs still going")
+		signalRuns(scripts, syscall.SIGKILL)
+		waitForScripts(scripts, time.After(10*time.Second), nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("failed to shut down the HTTP server cleanly", "err", err)
+	}
+	if !waitForNotifications(*flagShutdownTimeout) {
+		slog.Warn("giving up on notifications still being sent")
+	}
+	db.Close()
+	slog.Info("shut down")
+}
+
+func signalRuns(scripts []*Script, sig os.Signal) {
+	for _, s := range scripts {
+		if _, err := s.kill(sig); err == nil {
+			s.logger().Info("sent signal to run on shutdown", "signal", sig.String())
+		}
+	}
+}
+
+// waitForScripts waits until the loops of the scripts ended, and tells if
+// they did before the deadline or a signal.
+func waitForScripts(scripts []*Script, deadline <-chan time.Time, sigch <-chan os.Signal) bool {
+	for _, s := range scripts {
+		select {
+		case <-s.quitch:
+		case <-deadline:
+			return false
+		case sig := <-sigch:
+			slog.Warn("received another signal, not waiting for runs to finish", "signal", sig.String())
+			return false
+		}
+	}
+	return true
+}
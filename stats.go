@@ -0,0 +1,365 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// statsWindows are the periods, in days, the statistics page offers.
+var statsWindows = []int{7, 30, 90, 365}
+
+// sparklineDays is how many days back the sparklines on the list page go.
+const sparklineDays = 14
+
+// anomalousStates are the states of runs counted as failures. Runs still in
+// progress and skipped ones count neither as failures nor as successes.
+var anomalousStates = []int64{
+	int64(StateFailed),
+	int64(StateInterrupted),
+	int64(StateKilled),
+	int64(StateNonzeroCode),
+	int64(StateMissed),
+}
+
+// sqlDuration is an SQL expression for the run time of a run in seconds.
+func sqlDuration() string {
+	if db.Dialect().GetName() == "postgres" {
+		return "EXTRACT(EPOCH FROM (finish_time - start_time))"
+	}
+	return "((julianday(finish_time) - julianday(start_time)) * 86400.0)"
+}
+
+// sqlDay is an SQL expression for the day in UTC a run started on, as
+// YYYY-MM-DD.
+func sqlDay() string {
+	if db.Dialect().GetName() == "postgres" {
+		return "to_char(start_time AT TIME ZONE 'UTC', 'YYYY-MM-DD')"
+	}
+	return "date(" + sqlTime("start_time") + ")"
+}
+
+// sqlSince is an SQL condition for runs to have started at the time bound
+// to it or later.
+func sqlSince() string {
+	return sqlTime("start_time") + " >= " + sqlTime("?")
+}
+
+type dayStats struct {
+	Day         string
+	Runs        int
+	Failures    int
+	AvgDuration float64
+}
+
+func (d dayStats) MeanDuration() time.Duration {
+	return time.Duration(d.AvgDuration * float64(time.Second))
+}
+
+func (d dayStats) SuccessRate() float64 {
+	return successRate(d.Runs, d.Failures)
+}
+
+func (d dayStats) FailureRate() float64 {
+	if d.Runs == 0 {
+		return 0
+	}
+	return 100 - d.SuccessRate()
+}
+
+type causeStats struct {
+	Cause    Cause
+	Runs     int
+	Failures int
+}
+
+type percentile struct {
+	P        int
+	Duration time.Duration
+}
+
+type scriptStats struct {
+	Days        []dayStats
+	Causes      []causeStats
+	Percentiles []percentile
+	Runs        int
+	Failures    int
+
+	// Trend is the change of the mean run time per day, from a linear fit
+	// of the daily means.
+	Trend    time.Duration
+	HasTrend bool
+
+	// MTBF is the mean time between failures.
+	MTBF    time.Duration
+	HasMTBF bool
+}
+
+func (s scriptStats) SuccessRate() float64 {
+	return successRate(s.Runs, s.Failures)
+}
+
+func successRate(runs, failures int) float64 {
+	if runs == 0 {
+		return 0
+	}
+	return 100 * float64(runs-failures) / float64(runs)
+}
+
+func computeStats(scriptID int, since time.Time) (scriptStats, error) {
+	var st scriptStats
+
+	rows, err := db.Raw("SELECT "+sqlDay()+", COUNT(*), "+
+		"SUM(CASE WHEN state IN (?) THEN 1 ELSE 0 END), "+
+		"AVG(CASE WHEN finish_time IS NOT NULL THEN "+sqlDuration()+" END) "+
+		"FROM runs WHERE script_id = ? AND "+sqlSince()+" AND state <> ? "+
+		"GROUP BY "+sqlDay()+" ORDER BY 1",
+		anomalousStates, scriptID, since, int64(StateSkipped)).Rows()
+	if err != nil {
+		return st, err
+	}
+	for rows.Next() {
+		var d dayStats
+		var avg sql.NullFloat64
+		if err = rows.Scan(&d.Day, &d.Runs, &d.Failures, &avg); err != nil {
+			rows.Close()
+			return st, err
+		}
+		d.AvgDuration = avg.Float64
+		st.Days = append(st.Days, d)
+		st.Runs += d.Runs
+		st.Failures += d.Failures
+	}
+	rows.Close()
+
+	rows, err = db.Raw("SELECT cause, COUNT(*), SUM(CASE WHEN state IN (?) THEN 1 ELSE 0 END) "+
+		"FROM runs WHERE script_id = ? AND "+sqlSince()+" AND state <> ? GROUP BY cause ORDER BY 2 DESC",
+		anomalousStates, scriptID, since, int64(StateSkipped)).Rows()
+	if err != nil {
+		return st, err
+	}
+	for rows.Next() {
+		var c causeStats
+		if err = rows.Scan(&c.Cause, &c.Runs, &c.Failures); err != nil {
+			rows.Close()
+			return st, err
+		}
+		st.Causes = append(st.Causes, c)
+	}
+	rows.Close()
+
+	if st.Percentiles, err = durationPercentiles(scriptID, since); err != nil {
+		return st, err
+	}
+	st.Trend, st.HasTrend = durationTrend(st.Days)
+
+	if st.Failures >= 2 {
+		var first, last Run
+		failed := db.Where("script_id = ? AND "+sqlSince()+" AND state IN (?)", scriptID, since, anomalousStates)
+		if err = failed.Order(sqlTime("start_time")).First(&first).Error; err != nil {
+			return st, err
+		}
+		if err = failed.Order(sqlTime("start_time") + " desc").First(&last).Error; err != nil {
+			return st, err
+		}
+		st.MTBF = last.StartTime.Sub(first.StartTime) / time.Duration(st.Failures-1)
+		st.HasMTBF = true
+	}
+
+	return st, nil
+}
+
+// statsPercentiles are the percentiles of run times the statistics show.
+var statsPercentiles = []int{50, 90, 99, 100}
+
+// nearestRank returns the rank of the p-th percentile of n values,
+// ceil(p/100 * n). sqlNearestRank is the same in SQL.
+func nearestRank(p, n int) int {
+	return (p*n + 99) / 100
+}
+
+func sqlNearestRank(p int, n string) string {
+	return fmt.Sprintf("(%d * %s + 99) / 100", p, n)
+}
+
+// durationPercentiles picks the percentiles of run times of finished runs,
+// numbering them in order of run time and keeping the rows at the ranks.
+func durationPercentiles(scriptID int, since time.Time) ([]percentile, error) {
+	var ranks []string
+	for _, p := range statsPercentiles {
+		ranks = append(ranks, "rn = "+sqlNearestRank(p, "n"))
+	}
+	rows, err := db.Raw("SELECT rn, n, d FROM ("+
+		"SELECT "+sqlDuration()+" AS d, ROW_NUMBER() OVER (ORDER BY "+sqlDuration()+") AS rn, COUNT(*) OVER () AS n "+
+		"FROM runs WHERE script_id = ? AND "+sqlSince()+" AND finish_time IS NOT NULL AND state <> ?"+
+		") ranked WHERE "+strings.Join(ranks, " OR ")+" ORDER BY rn",
+		scriptID, since, int64(StateSkipped)).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []percentile
+	for rows.Next() {
+		var rn, n int
+		var seconds float64
+		if err := rows.Scan(&rn, &n, &seconds); err != nil {
+			return nil, err
+		}
+		// one run can be at several percentiles
+		for _, p := range statsPercentiles {
+			if rn == nearestRank(p, n) {
+				ret = append(ret, percentile{P: p, Duration: time.Duration(seconds * float64(time.Second))})
+			}
+		}
+	}
+	return ret, rows.Err()
+}
+
+// durationTrend fits a line through the daily mean run times by least
+// squares and returns its slope per day.
+func durationTrend(days []dayStats) (time.Duration, bool) {
+	if len(days) < 2 {
+		return 0, false
+	}
+
+	var sx, sy, sxx, sxy float64
+	first, _ := time.Parse("2006-01-02", days[0].Day)
+	for _, d := range days {
+		day, _ := time.Parse("2006-01-02", d.Day)
+		x := day.Sub(first).Hours() / 24
+		sx += x
+		sy += d.AvgDuration
+		sxx += x * x
+		sxy += x * d.AvgDuration
+	}
+	n := float64(len(days))
+	denom := n*sxx - sx*sx
+	if denom == 0 {
+		return 0, false
+	}
+	slope := (n*sxy - sx*sy) / denom
+	return time.Duration(slope * float64(time.Second)), true
+}
+
+// sparklines draws a small bar chart of the daily runs of every script over
+// the last sparklineDays days, with the anomalous part of each bar in red.
+func sparklines() (map[int]template.HTML, error) {
+	// days are those of UTC, like the ones the queries group by
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	since := today.AddDate(0, 0, -(sparklineDays - 1))
+
+	rows, err := db.Raw("SELECT script_id, "+sqlDay()+", COUNT(*), "+
+		"SUM(CASE WHEN state IN (?) THEN 1 ELSE 0 END) "+
+		"FROM runs WHERE "+sqlSince()+" AND state <> ? "+
+		"GROUP BY script_id, "+sqlDay(),
+		anomalousStates, since, int64(StateSkipped)).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	perScript := make(map[int]map[string]dayStats)
+	for rows.Next() {
+		var id int
+		var d dayStats
+		if err = rows.Scan(&id, &d.Day, &d.Runs, &d.Failures); err != nil {
+			return nil, err
+		}
+		if perScript[id] == nil {
+			perScript[id] = make(map[string]dayStats)
+		}
+		perScript[id][d.Day] = d
+	}
+
+	ret := make(map[int]template.HTML)
+	for id, days := range perScript {
+		ret[id] = sparkline(days, since)
+	}
+	return ret, nil
+}
+
+func sparkline(days map[string]dayStats, since time.Time) template.HTML {
+	const barWidth, height = 6, 20
+
+	max := 1
+	for _, d := range days {
+		if d.Runs > max {
+			max = d.Runs
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg width="%d" height="%d" class="sparkline">`, sparklineDays*barWidth, height)
+	for i := 0; i < sparklineDays; i++ {
+		day := since.AddDate(0, 0, i).Format("2006-01-02")
+		d := days[day]
+		x := i * barWidth
+		if d.Runs == 0 {
+			fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="1" fill="#ccc"><title>%s: no runs</title></rect>`,
+				x, height-1, barWidth-1, day)
+			continue
+		}
+		h := int(math.Max(2, math.Round(float64(d.Runs)/float64(max)*height)))
+		fh := int(math.Round(float64(h) * float64(d.Failures) / float64(d.Runs)))
+		fmt.Fprintf(&b, `<g><title>%s: %d runs, %d anomalous</title>`, day, d.Runs, d.Failures)
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="#28a745"/>`, x, height-h, barWidth-1, h)
+		if fh > 0 {
+			fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="#dc3545"/>`, x, height-fh, barWidth-1, fh)
+		}
+		b.WriteString(`</g>`)
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// statsDays returns the period of the statistics for the days parameter,
+// rounded up to one of statsWindows, so that the queries stay bounded.
+func statsDays(param string) int {
+	n, err := strconv.Atoi(param)
+	if err != nil || n <= 0 {
+		return 30
+	}
+	for _, days := range statsWindows {
+		if n <= days {
+			return days
+		}
+	}
+	return statsWindows[len(statsWindows)-1]
+}
+
+func showStats(w http.ResponseWriter, r *http.Request, u user) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	s, ok := allScripts.lookup(id)
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	days := statsDays(r.URL.Query().Get("days"))
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -(days - 1))
+
+	st, err := computeStats(s.ID, since)
+	if err != nil {
+		reqLog(r).Error("failed to compute statistics", "script_id", s.ID, "err", err)
+		http.Error(w, "failed to compute statistics", 500)
+		return
+	}
+
+	execTmpl(w, r, "stats", map[string]interface{}{
+		"user":    u,
+		"Script":  s,
+		"stats":   st,
+		"days":    days,
+		"windows": statsWindows,
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// addRun adds a run of the script starting at start, which took duration
+// if it finished.
+func addRun(t *testing.T, scriptID, runNo int, start time.Time, duration time.Duration, state State, cause Cause) {
+	run := Run{ScriptID: scriptID, RunNo: runNo, StartTime: start, State: state, Cause: cause}
+	if state != StateRunning {
+		finish := start.Add(duration)
+		run.FinishTime = &finish
+	}
+	if err := db.Create(&run).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestComputeStats(t *testing.T) {
+	testDB(t)
+
+	day1 := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	// on the first day, runs of 10s to 90s; the last one failed
+	for i := 1; i <= 9; i++ {
+		state := StateDone
+		if i == 9 {
+			state = StateNonzeroCode
+		}
+		addRun(t, 1, i, day1.Add(time.Duration(i)*time.Minute), time.Duration(i)*10*time.Second, state, CausePeriodic)
+	}
+	// on the second day, a failed manual run of 100s, one still running
+	// and one skipped
+	addRun(t, 1, 10, day2, 100*time.Second, StateFailed, CauseManual)
+	addRun(t, 1, 11, day2.Add(time.Hour), 0, StateRunning, CauseManual)
+	addRun(t, 1, 12, day2.Add(2*time.Hour), 0, StateSkipped, CausePeriodic)
+	// another script's run, and a run before the window
+	addRun(t, 2, 1, day2, time.Hour, StateFailed, CauseManual)
+	addRun(t, 1, 13, day1.AddDate(0, 0, -2), time.Hour, StateFailed, CauseManual)
+
+	st, err := computeStats(1, day1.Truncate(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(st.Days) != 2 {
+		t.Fatalf("days: %+v", st.Days)
+	}
+	if d := st.Days[0]; d.Day != "2026-03-02" || d.Runs != 9 || d.Failures != 1 || d.MeanDuration().Round(time.Millisecond) != 50*time.Second {
+		t.Errorf("first day: %+v", d)
+	}
+	if d := st.Days[1]; d.Day != "2026-03-03" || d.Runs != 2 || d.Failures != 1 || d.MeanDuration().Round(time.Millisecond) != 100*time.Second {
+		t.Errorf("second day: %+v", d)
+	}
+	if st.Runs != 11 || st.Failures != 2 {
+		t.Errorf("%d runs, %d failures", st.Runs, st.Failures)
+	}
+
+	var got []time.Duration
+	for _, p := range st.Percentiles {
+		got = append(got, p.Duration.Round(time.Millisecond))
+	}
+	want := []time.Duration{50 * time.Second, 90 * time.Second, 100 * time.Second, 100 * time.Second}
+	if len(got) != len(want) {
+		t.Fatalf("percentiles: %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("p%d = %s, want %s", st.Percentiles[i].P, got[i], want[i])
+		}
+	}
+
+	// the skipped run counts for no cause
+	causes := make(map[Cause]causeStats)
+	for _, c := range st.Causes {
+		causes[c.Cause] = c
+	}
+	if c := causes[CausePeriodic]; len(causes) != 2 || c.Runs != 9 || c.Failures != 1 {
+		t.Errorf("causes: %+v", st.Causes)
+	}
+	if c := causes[CauseManual]; c.Runs != 2 || c.Failures != 1 {
+		t.Errorf("causes: %+v", st.Causes)
+	}
+
+	if !st.HasTrend || st.Trend.Round(time.Millisecond) != 50*time.Second {
+		t.Errorf("trend %s, %v", st.Trend, st.HasTrend)
+	}
+	// between the failures at 12:09 and 12:00 the next day
+	if !st.HasMTBF || st.MTBF != day2.Sub(day1.Add(9*time.Minute)) {
+		t.Errorf("MTBF %s, %v", st.MTBF, st.HasMTBF)
+	}
+
+	if st, err := computeStats(3, day1); err != nil || st.Percentiles != nil {
+		t.Errorf("no runs: %+v, %v", st.Percentiles, err)
+	}
+}
+
+func TestNearestRank(t *testing.T) {
+	for _, tc := range []struct{ p, n, rank int }{
+		{50, 10, 5}, {90, 10, 9}, {99, 10, 10}, {100, 10, 10},
+		{50, 1, 1}, {99, 1, 1}, {50, 3, 2}, {99, 101, 100},
+	} {
+		if got := nearestRank(tc.p, tc.n); got != tc.rank {
+			t.Errorf("nearestRank(%d, %d) = %d, want %d", tc.p, tc.n, got, tc.rank)
+		}
+	}
+}
+
+func TestStatsDays(t *testing.T) {
+	for param, want := range map[string]int{
+		"": 30, "x": 30, "0": 30, "-5": 30,
+		"7": 7, "8": 30, "90": 90, "365": 365, "100000": 365,
+	} {
+		if got := statsDays(param); got != want {
+			t.Errorf("statsDays(%q) = %d, want %d", param, got, want)
+		}
+	}
+}
+
+func TestSparklinesWestOfUTC(t *testing.T) {
+	testDB(t)
+	local := time.Local
+	time.Local = time.FixedZone("PDT", -7*3600)
+	t.Cleanup(func() { time.Local = local })
+
+	addRun(t, 1, 1, time.Now(), time.Second, StateDone, CauseManual)
+	lines, err := sparklines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	today := time.Now().UTC().Format("2006-01-02")
+	if want := "<title>" + today + ": 1 runs, 0 anomalous</title>"; !strings.Contains(string(lines[1]), want) {
+		t.Errorf("sparkline lacks %q: %s", want, lines[1])
+	}
+}
+
+func TestComputeStatsAcrossOffsets(t *testing.T) {
+	testDB(t)
+
+	// runs written with the offsets of zones on both sides of UTC, whose
+	// local dates differ from those in UTC
+	since := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	addRun(t, 1, 1, since.Add(2*time.Hour).In(time.FixedZone("EST", -5*3600)), time.Second, StateFailed, CauseManual)
+	addRun(t, 1, 2, since.Add(-time.Hour).In(time.FixedZone("MSK", 3*3600)), time.Second, StateFailed, CauseManual)
+	addRun(t, 1, 3, since.Add(3*time.Hour).In(time.FixedZone("MSK", 3*3600)), time.Second, StateFailed, CauseManual)
+
+	st, err := computeStats(1, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Days) != 1 || st.Days[0].Day != "2026-03-02" || st.Runs != 2 {
+		t.Errorf("days: %+v", st.Days)
+	}
+	if len(st.Causes) != 1 || st.Causes[0].Runs != 2 || len(st.Percentiles) == 0 {
+		t.Errorf("causes %+v, percentiles %+v", st.Causes, st.Percentiles)
+	}
+	if !st.HasMTBF || st.MTBF != time.Hour {
+		t.Errorf("MTBF %s, %v", st.MTBF, st.HasMTBF)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Scripts do not run as children of runtriggers itself, but of a small
+// supervisor, runtriggers started with the supervise command, in a session
+// of its own. Runs thus go on when runtriggers exits or restarts. The
+// supervisor records its process and, once the script exits, the exit
+// code in a status file next to the run's log, from which runtriggers
+// picks the run up again on start.
+
+// runStatus is the content of a status file.
+type runStatus struct {
+	Pid      int        `json:"pid"`
+	Command  string     `json:"command"`
+	ExitCode *int       `json:"exit_code,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// Signals which cannot be caught are sent to the supervisor as these, to
+// be passed on as the real thing.
+var supervisorSignals = map[syscall.Signal]syscall.Signal{
+	syscall.SIGKILL: syscall.SIGUSR2,
+}
+
+func statusFilename(run Run) string {
+	return run.LogFilename + ".status"
+}
+
+func writeRunStatus(path string, status runStatus) error {
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func readRunStatus(run Run) (runStatus, error) {
+	var status runStatus
+	b, err := ioutil.ReadFile(statusFilename(run))
+	if err != nil {
+		return status, err
+	}
+	return status, json.Unmarshal(b, &status)
+}
+
+// supervising tells if the process is alive and the supervisor of the run,
+// and not some other process which got its PID after it exited.
+func supervising(pid int, run Run) bool {
+	if pid <= 0 || syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	cmdline, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		// no procfs to check against
+		return true
+	}
+	return bytes.Contains(cmdline, []byte(statusFilename(run)+"\x00"))
+}
+
+// unlinkedFile returns a file with the content, which is gone once
+// closed. Supervisors get such files rather than pipes, which would break
+// with runtriggers.
+func unlinkedFile(prefix, content string) (*os.File, error) {
+	f, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// startSupervised starts argv under a supervisor, with the text on its
+// standard input and its output going to f. The supervisor passes env on
+// to argv, on file descriptor 3 rather than in its own environment. The
+// returned channel is closed when the supervisor exits.
+func startSupervised(run Run, argv, env []string, text string, f *os.File) (*os.Process, <-chan struct{}, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stdin, err := unlinkedFile("runtriggers-stdin-", text)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stdin.Close()
+	envFile, err := unlinkedFile("runtriggers-env-", strings.Join(env, "\x00"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer envFile.Close()
+
+	cmd := exec.Cmd{
+		Path:        self,
+		Args:        append([]string{self, "supervise", statusFilename(run), "--"}, argv...),
+		Stdin:       stdin,
+		Stdout:      f,
+		Stderr:      f,
+		ExtraFiles:  []*os.File{envFile},
+		SysProcAttr: &syscall.SysProcAttr{Setsid: true},
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	return cmd.Process, exited, nil
+}
+
+func signalSupervisor(pid int, sig syscall.Signal) error {
+	if s, ok := supervisorSignals[sig]; ok {
+		sig = s
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// readSupervisedEnv reads the variables runtriggers passes on file
+// descriptor 3 for the command.
+func readSupervisedEnv() []string {
+	f := os.NewFile(3, "env")
+	if f == nil {
+		return nil
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	return strings.Split(string(b), "\x00")
+}
+
+// superviseCommand implements the supervise command, which runtriggers
+// runs scripts with. Its standard input, output and error are the
+// script's.
+func superviseCommand(args []string) int {
+	if len(args) < 3 || args[1] != "--" {
+		fmt.Fprintln(os.Stderr, "usage: runtriggers supervise STATUS_FILE -- COMMAND [ARG...]")
+		return 2
+	}
+	path, argv := args[0], args[2:]
+	status := runStatus{Pid: os.Getpid(), Command: argv[0]}
+	if len(argv) > 2 {
+		// su-exec USER COMMAND...
+		status.Command = argv[2]
+	}
+
+	sigch := make(chan os.Signal, 4)
+	signal.Notify(sigch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR2)
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if env := readSupervisedEnv(); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	if err := cmd.Start(); err != nil {
+		now := time.Now()
+		code := -1
+		status.ExitCode, status.Error, status.Finished = &code, err.Error(), &now
+		writeRunStatus(path, status)
+		return 1
+	}
+	if err := writeRunStatus(path, status); err != nil {
+		fmt.Fprintf(os.Stderr, "runtriggers: %s\n", err)
+	}
+
+	go func() {
+		for sig := range sigch {
+			if sig == syscall.SIGUSR2 {
+				sig = syscall.SIGKILL
+			}
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	cmd.Wait()
+	now := time.Now()
+	code := cmd.ProcessState.ExitCode()
+	status.ExitCode, status.Finished = &code, &now
+	if err := writeRunStatus(path, status); err != nil {
+		fmt.Fprintf(os.Stderr, "runtriggers: %s\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain lets the test binary stand in for runtriggers as the supervisor,
+// since startSupervised runs os.Executable.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == "supervise" {
+		os.Exit(superviseCommand(os.Args[2:]))
+	}
+	os.Exit(m.Run())
+}
+
+// supervisedScript returns a script saved in the test database and a run
+// of it, with its log file created.
+func supervisedScript(t *testing.T) (*Script, Run) {
+	testDB(t)
+	s := &Script{Name: "sync", Owner: "alice", Kind: KindScript, changech: make(chan struct{})}
+	if err := db.Create(s).Error; err != nil {
+		t.Fatal(err)
+	}
+	run := Run{ScriptID: s.ID, RunNo: 1, StartTime: time.Now(), State: StateRunning, Cause: CauseManual,
+		LogFilename: filepath.Join(t.TempDir(), "1.log"), Script: s}
+	if err := ioutil.WriteFile(run.LogFilename, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&run).Error; err != nil {
+		t.Fatal(err)
+	}
+	return s, run
+}
+
+func startTestSupervised(t *testing.T, run Run, argv ...string) (*os.Process, <-chan struct{}) {
+	f, err := os.OpenFile(run.LogFilename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	proc, exited, err := startSupervised(run, argv, nil, "", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		syscall.Kill(-proc.Pid, syscall.SIGKILL)
+		<-exited
+	})
+	return proc, exited
+}
+
+// waitStarted waits for the supervisor to write the status of the started
+// command.
+func waitStarted(t *testing.T, run Run) runStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, err := readRunStatus(run)
+		if err == nil {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no status file: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func savedRun(t *testing.T, run Run) Run {
+	var saved Run
+	if err := db.Where("script_id = ? AND run_no = ?", run.ScriptID, run.RunNo).First(&saved).Error; err != nil {
+		t.Fatal(err)
+	}
+	return saved
+}
+
+func TestSupervisedKill(t *testing.T) {
+	_, run := supervisedScript(t)
+	proc, exited := startTestSupervised(t, run, "/bin/sh", "-c", "sleep 30")
+	waitStarted(t, run)
+
+	// SIGKILL would kill the supervisor, which gets SIGUSR2 to pass it on
+	if err := signalSupervisor(proc.Pid, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not exit")
+	}
+	status, err := readRunStatus(run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Finished == nil || status.ExitCode == nil || *status.ExitCode != -1 {
+		t.Errorf("got status %+v, want the command killed by a signal", status)
+	}
+}
+
+func TestSupervisedStartError(t *testing.T) {
+	s, run := supervisedScript(t)
+	proc, exited := startTestSupervised(t, run, filepath.Join(t.TempDir(), "missing"))
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not exit")
+	}
+	status, err := readRunStatus(run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Error == "" || status.Finished == nil || status.ExitCode == nil || *status.ExitCode != -1 {
+		t.Errorf("got status %+v, want a start error", status)
+	}
+
+	if !s.await(&run, devNull, proc.Pid, exited) {
+		t.Fatal("await detached")
+	}
+	if run.State != StateFailed {
+		t.Errorf("got state %v, want %v", run.State, StateFailed)
+	}
+}
+
+func TestResumeOutlivedRun(t *testing.T) {
+	s, run := supervisedScript(t)
+	// the supervisor outlives the runtriggers process which started it, and
+	// is waited for by polling like after a restart
+	startTestSupervised(t, run, "/bin/sh", "-c", "sleep 1; exit 3")
+	waitStarted(t, run)
+	s.resume(run)
+
+	saved := savedRun(t, run)
+	if saved.State != StateNonzeroCode || saved.ExitCode != 3 || saved.FinishTime == nil {
+		t.Errorf("got state %v, exit code %d, finish time %v; want %v, 3 and a finish time",
+			saved.State, saved.ExitCode, saved.FinishTime, StateNonzeroCode)
+	}
+	if _, err := os.Stat(statusFilename(run)); !os.IsNotExist(err) {
+		t.Errorf("status file left behind: %v", err)
+	}
+}
+
+func TestResumeGoneSupervisor(t *testing.T) {
+	s, run := supervisedScript(t)
+	// a PID which is free again
+	cmd := exec.Command("/bin/true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeRunStatus(statusFilename(run), runStatus{Pid: cmd.Process.Pid, Command: "/bin/sh"}); err != nil {
+		t.Fatal(err)
+	}
+	s.resume(run)
+
+	if saved := savedRun(t, run); saved.State != StateInterrupted {
+		t.Errorf("got state %v, want %v", saved.State, StateInterrupted)
+	}
+	if _, err := os.Stat(statusFilename(run)); !os.IsNotExist(err) {
+		t.Errorf("status file left behind: %v", err)
+	}
+}
@@ -2,62 +2,59 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 )
 
+// parseTime parses "now" or an RFC 3339 time, followed by durations to add
+// or subtract, like "now-24h" or "2024-05-01T00:00:00Z +1h -5m". Spaces and
+// commas may separate the parts.
 func parseTime(inp string) (time.Time, error) {
+	inp = strings.TrimSpace(inp)
+	if inp == "" {
+		return time.Time{}, errors.New("no time specified")
+	}
+
 	var t time.Time
-	var err error
-	var op string
-	first := true
-	for inp != "" {
+	var rest string
+	if strings.HasPrefix(inp, "now") {
+		t, rest = time.Now(), inp[len("now"):]
+	} else {
+		// RFC 3339 times have signs of their own, they end at a separator
 		idx := strings.IndexAny(inp, ", ")
 		if idx < 0 {
 			idx = len(inp)
 		}
-		tok := inp[:idx]
-		inp = inp[idx:]
-		if len(inp) > 0 {
-			// skip separator
-			inp = inp[1:]
+		var err error
+		if t, err = time.Parse(time.RFC3339, inp[:idx]); err != nil {
+			return time.Time{}, err
 		}
+		rest = inp[idx:]
+	}
 
-		if first {
-			switch tok {
-			case "now":
-				t = time.Now()
-			default:
-				t, err = time.Parse(time.RFC3339, tok)
-				if err != nil {
-					return time.Time{}, err
-				}
-			}
-		} else {
-			var d time.Duration
-			d, err = time.ParseDuration(tok)
-			if err != nil {
-				return time.Time{}, err
-			}
-			switch op {
-			case "+":
-				t = t.Add(d)
-			case "-":
-				t = t.Add(-d)
-			default:
-				panic("bug")
-			}
+	for {
+		rest = strings.TrimLeft(rest, ", ")
+		if rest == "" {
+			return t, nil
 		}
-
-		if inp != "" {
-			op = inp[0:1]
-			inp = inp[1:]
+		op := rest[0]
+		if op != '+' && op != '-' {
+			return time.Time{}, fmt.Errorf("expected + or - before %q", rest)
 		}
-		first = false
-	}
-	if first {
-		return time.Time{}, errors.New("no time specified")
-	} else {
-		return t, nil
+		rest = strings.TrimLeft(rest[1:], " ")
+		idx := strings.IndexAny(rest, "+-, ")
+		if idx < 0 {
+			idx = len(rest)
+		}
+		d, err := time.ParseDuration(rest[:idx])
+		if err != nil {
+			return time.Time{}, err
+		}
+		if op == '-' {
+			d = -d
+		}
+		t = t.Add(d)
+		rest = rest[idx:]
 	}
 }
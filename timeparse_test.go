@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	base := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for inp, want := range map[string]time.Time{
+		"2024-05-01T00:00:00Z":            base,
+		"2024-05-01T02:00:00+02:00":       base,
+		"2024-05-01T00:00:00Z +1h":        base.Add(time.Hour),
+		"2024-05-01T00:00:00Z,+1h,-5m":    base.Add(55 * time.Minute),
+		"2024-05-01T00:00:00Z -1h30m +5m": base.Add(-85 * time.Minute),
+	} {
+		got, err := parseTime(inp)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("parseTime(%q) = %s, %v, want %s", inp, got, err, want)
+		}
+	}
+
+	// relative to now, as the filters of the audit log and runs suggest
+	for inp, offset := range map[string]time.Duration{
+		"now":          0,
+		"now-24h":      -24 * time.Hour,
+		"now -24h":     -24 * time.Hour,
+		"now - 24h":    -24 * time.Hour,
+		"now,-1h":      -time.Hour,
+		"now+1h-30m":   30 * time.Minute,
+		" now -1h +1m": -59 * time.Minute,
+	} {
+		before := time.Now()
+		got, err := parseTime(inp)
+		after := time.Now()
+		if err != nil || got.Before(before.Add(offset)) || got.After(after.Add(offset)) {
+			t.Errorf("parseTime(%q) = %s, %v, want now%+v", inp, got, err, offset)
+		}
+	}
+
+	for _, inp := range []string{"", " ", "yesterday", "nowish", "now 24h", "now-", "now-24", "2024-05-01"} {
+		if got, err := parseTime(inp); err == nil {
+			t.Errorf("parseTime(%q) = %s, want error", inp, got)
+		}
+	}
+}
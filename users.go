@@ -11,17 +11,18 @@ var (
 	flagAdminUsers = flag.String("admins", "", "comma-separated list of admin usernames")
 )
 
-var isAdminMap map[user]bool
-
-func initUsers() {
-	isAdminMap = make(map[user]bool)
-	for _, un := range strings.Split(*flagAdminUsers, ",") {
-		isAdminMap[user(un)] = true
+func parseUsers(list string) map[user]bool {
+	users := make(map[user]bool)
+	for _, un := range strings.Split(list, ",") {
+		if un = strings.TrimSpace(un); un != "" {
+			users[user(un)] = true
+		}
 	}
+	return users
 }
 
 func (u user) IsAdmin() bool {
-	return isAdminMap[u]
+	return cfg().admins[u]
 }
 
 func (u user) CanAccessJob(jobOwner user) bool {
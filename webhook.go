@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	flagWebhookRetries    = flag.Int("webhook-retries", 3, "number of times to retry delivering a webhook")
+	flagWebhookRetryDelay = flag.Duration("webhook-retry-delay", 30*time.Second, "delay before the first webhook retry, doubled on each further retry")
+	flagWebhookLogLines   = flag.Int("webhook-log-lines", 20, "number of lines from the end of the run's log to include in webhooks")
+)
+
+var webhookFormats = []string{"json", "slack", "mattermost", "matrix"}
+
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+type webhookScript struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Owner user   `json:"owner"`
+	URL   string `json:"url"`
+}
+
+type webhookRun struct {
+	No         int        `json:"no"`
+	State      string     `json:"state"`
+	Cause      string     `json:"cause"`
+	ExitCode   int        `json:"exit_code"`
+	StartTime  time.Time  `json:"start_time"`
+	FinishTime *time.Time `json:"finish_time,omitempty"`
+	Duration   float64    `json:"duration"`
+	LogURL     string     `json:"log_url"`
+}
+
+// webhookPayload is the body of webhooks in the json format. The other
+// formats are built from it.
+type webhookPayload struct {
+	Event   string        `json:"event"`
+	Script  webhookScript `json:"script"`
+	Run     webhookRun    `json:"run"`
+	LogTail []string      `json:"log_tail"`
+}
+
+func newWebhookPayload(event string, s Script, r Run) webhookPayload {
+	return webhookPayload{
+		Event: event,
+		Script: webhookScript{
+			ID:    s.ID,
+			Name:  s.Name,
+			Owner: s.Owner,
+			URL:   backLink(fmt.Sprintf("/scripts/%d", s.ID)),
+		},
+		Run: webhookRun{
+			No:         r.RunNo,
+			State:      stateName(r.State),
+			Cause:      r.Cause.String(),
+			ExitCode:   r.ExitCode,
+			StartTime:  r.StartTime,
+			FinishTime: r.FinishTime,
+			Duration:   r.Duration().Seconds(),
+			LogURL:     backLink(fmt.Sprintf("/scripts/%d/logs/%d", s.ID, r.RunNo)),
+		},
+		LogTail: logTail(r.LogFilename, cfg().webhookLogLines),
+	}
+}
+
+func (p webhookPayload) summary() string {
+	return fmt.Sprintf("Run #%d of script %q %s (%s, exit code %d, run time %s)",
+		p.Run.No, p.Script.Name, p.Event, p.Run.State, p.Run.ExitCode,
+		FormatDuration(time.Duration(p.Run.Duration*float64(time.Second))))
+}
+
+func (p webhookPayload) markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n[Log](%s) · [Script](%s)", p.summary(), p.Run.LogURL, p.Script.URL)
+	if len(p.LogTail) > 0 {
+		fmt.Fprintf(&b, "\n```\n%s\n```", strings.Join(p.LogTail, "\n"))
+	}
+	return b.String()
+}
+
+// plain is the message in plain text, for clients showing no HTML.
+func (p webhookPayload) plain() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\nLog: %s\nScript: %s", p.summary(), p.Run.LogURL, p.Script.URL)
+	if len(p.LogTail) > 0 {
+		fmt.Fprintf(&b, "\n\n%s", strings.Join(p.LogTail, "\n"))
+	}
+	return b.String()
+}
+
+// html is the message as the HTML Matrix clients show.
+func (p webhookPayload) html() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `%s<br><a href="%s">Log</a> · <a href="%s">Script</a>`,
+		html.EscapeString(p.summary()), html.EscapeString(p.Run.LogURL), html.EscapeString(p.Script.URL))
+	if len(p.LogTail) > 0 {
+		fmt.Fprintf(&b, "<pre><code>%s</code></pre>", html.EscapeString(strings.Join(p.LogTail, "\n")))
+	}
+	return b.String()
+}
+
+func (p webhookPayload) format(format string) ([]byte, error) {
+	switch format {
+	case "", "json":
+		return json.Marshal(p)
+	case "slack":
+		return json.Marshal(map[string]string{
+			"text": p.markdown(),
+		})
+	case "mattermost":
+		return json.Marshal(map[string]string{
+			"text":     p.markdown(),
+			"username": "runtriggers",
+		})
+	case "matrix":
+		// for the generic webhooks of matrix-hookshot, which send the
+		// html as the formatted body of the m.room.message, and the
+		// text as its body
+		return json.Marshal(map[string]string{
+			"text":     p.plain(),
+			"html":     p.html(),
+			"username": "runtriggers",
+		})
+	default:
+		return nil, fmt.Errorf("unknown webhook format %q", format)
+	}
+}
+
+// webhookSignature returns the value of the X-Runtriggers-Signature header,
+// an HMAC-SHA256 of the body keyed by the script's webhook secret.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookHost returns the host of the webhook URL, which unlike the URL
+// can be logged: the URLs of incoming webhooks are credentials.
+func webhookHost(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "(bad URL)"
+	}
+	return u.Host
+}
+
+func postWebhook(target string, secret string, body []byte) error {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("bad webhook URL for %s", webhookHost(target))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "runtriggers")
+	if secret != "" {
+		req.Header.Set("X-Runtriggers-Signature", webhookSignature(secret, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		// without the URL the client puts in its errors
+		if uerr, ok := err.(*url.Error); ok {
+			return fmt.Errorf("posting to %s: %v", webhookHost(target), uerr.Err)
+		}
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("server responded with %s", resp.Status)
+		// client errors, like for a removed hook, come again on retrying,
+		// but for rate limits
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+func notifyWebhook(event string, s Script, r Run) {
+	if s.WebhookURL == "" {
+		return
+	}
+
+	l := s.logger().With("run_no", r.RunNo, "event", event)
+	body, err := newWebhookPayload(event, s, r).format(s.WebhookFormat)
+	if err != nil {
+		l.Error("failed to build webhook", "err", err)
+		metricNotificationFailures.WithLabelValues("webhook").Inc()
+		return
+	}
+
+	c := cfg()
+	err = retry(c.webhookRetries, c.webhookRetryDelay, func(attempt int, err error, delay time.Duration) {
+		l.Warn("posting webhook failed, retrying", "host", webhookHost(s.WebhookURL),
+			"attempt", attempt, "retry_in", delay, "err", err)
+	}, func() error {
+		return postWebhook(s.WebhookURL, s.WebhookSecret, body)
+	})
+	if err != nil {
+		l.Error("giving up posting webhook", "host", webhookHost(s.WebhookURL), "err", err)
+		metricNotificationFailures.WithLabelValues("webhook").Inc()
+		return
+	}
+	metricNotifications.WithLabelValues("webhook").Inc()
+}
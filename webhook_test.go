@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookMatrix(t *testing.T) {
+	p := webhookPayload{
+		Event:   "failed",
+		Script:  webhookScript{ID: 1, Name: "<deploy>", URL: "https://rt.example/scripts/1"},
+		Run:     webhookRun{No: 3, State: "failed", LogURL: "https://rt.example/scripts/1/logs/3"},
+		LogTail: []string{"make: *** [all] Error 1", "<done>"},
+	}
+	body, err := p.format("matrix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg map[string]string
+	if err := json.Unmarshal(body, &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(msg["text"], `"<deploy>"`) || strings.Contains(msg["text"], "](") {
+		t.Errorf("text %q", msg["text"])
+	}
+	for _, want := range []string{
+		`&#34;&lt;deploy&gt;&#34;`,
+		`<a href="https://rt.example/scripts/1/logs/3">Log</a>`,
+		"<pre><code>make: *** [all] Error 1\n&lt;done&gt;</code></pre>",
+	} {
+		if !strings.Contains(msg["html"], want) {
+			t.Errorf("html %q lacks %q", msg["html"], want)
+		}
+	}
+}
+
+func TestPostWebhookHidesURL(t *testing.T) {
+	// nothing listens on port 1
+	err := postWebhook("http://127.0.0.1:1/services/T000/B000/token", "", []byte("{}"))
+	if err == nil || strings.Contains(err.Error(), "token") || !strings.Contains(err.Error(), "127.0.0.1:1") {
+		t.Errorf("error %v", err)
+	}
+}
+
+func TestPostWebhookRetries(t *testing.T) {
+	for _, tc := range []struct {
+		status   int
+		attempts int
+	}{
+		{200, 1},
+		{400, 1},
+		{404, 1},
+		{410, 1},
+		{429, 3},
+		{500, 3},
+		{503, 3},
+	} {
+		attempts := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.WriteHeader(tc.status)
+		}))
+		err := retry(2, time.Millisecond, func(int, error, time.Duration) {}, func() error {
+			return postWebhook(srv.URL, "", []byte("{}"))
+		})
+		srv.Close()
+		if attempts != tc.attempts || (err == nil) != (tc.status == 200) {
+			t.Errorf("status %d: %d attempts, %v", tc.status, attempts, err)
+		}
+	}
+}